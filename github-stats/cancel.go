@@ -0,0 +1,31 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"os/signal"
+	"syscall"
+)
+
+// withSignals returns a copy of ctx which is cancelled on the first SIGINT
+// or SIGTERM. The process exits on the second one.
+func withSignals(ctx context.Context) (context.Context, context.CancelFunc) {
+	ctx, cancel := context.WithCancel(ctx)
+
+	c := make(chan os.Signal, 2)
+	signal.Notify(c, os.Interrupt, syscall.SIGTERM)
+	go func() {
+		select {
+		case <-c:
+			fmt.Fprintf(os.Stderr, "interrupted, waiting up to %s for in-flight queries (interrupt again to quit now)\n", gracePeriod)
+			cancel()
+		case <-ctx.Done():
+			return
+		}
+		<-c
+		os.Exit(130)
+	}()
+
+	return ctx, cancel
+}
@@ -0,0 +1,211 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"io/ioutil"
+	"net/url"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// credentialProvider looks up the access token of a host in one place. It
+// returns an empty token if it has none.
+type credentialProvider struct {
+	// name describes where the token is looked up, for the error messages.
+	name  func(host string) string
+	token func(host string) (string, error)
+}
+
+// credentialChain lists the places the access token of a host is looked up
+// in, in order. The first token found is used.
+var credentialChain = []credentialProvider{
+	{
+		name:  func(host string) string { return "-token" },
+		token: defaultOnly(func() (string, error) { return accessToken, nil }),
+	},
+	{
+		name:  tokenEnv,
+		token: func(host string) (string, error) { return os.Getenv(tokenEnv(host)), nil },
+	},
+	{
+		name:  func(host string) string { return "-token-file" },
+		token: defaultOnly(readTokenFile),
+	},
+	{
+		name:  func(host string) string { return "git credential fill" },
+		token: gitCredential,
+	},
+	{
+		name:  func(host string) string { return "gh hosts.yml" },
+		token: ghToken,
+	},
+}
+
+// defaultOnly restricts a provider to the default endpoint, so that its
+// token is never sent to other hosts.
+func defaultOnly(token func() (string, error)) func(host string) (string, error) {
+	return func(host string) (string, error) {
+		if host != "" && endpointFor(host) != defaultEndpoint {
+			return "", nil
+		}
+		return token()
+	}
+}
+
+// lookupToken returns the access token of a host, the empty host standing
+// for the default endpoint, from the first provider of the chain which has
+// one.
+func lookupToken(host string) (string, error) {
+	var tried []string
+	for _, p := range credentialChain {
+		token, err := p.token(host)
+		if err != nil {
+			return "", errors.Wrapf(err, "%s failed", p.name(host))
+		}
+		if token != "" {
+			return token, nil
+		}
+		tried = append(tried, p.name(host))
+	}
+	return "", errors.Errorf("no access token for %s, tried %s", credentialHost(host), strings.Join(tried, ", "))
+}
+
+// credentialHost returns the host name the credentials of a host are
+// stored under by git and gh, which is github.com for api.github.com.
+func credentialHost(host string) string {
+	if host != "" {
+		return host
+	}
+	u, err := url.Parse(defaultEndpoint)
+	if err != nil || u.Host == "api.github.com" {
+		return "github.com"
+	}
+	return u.Host
+}
+
+// readTokensFile reads the pool of access tokens from -tokens-file, one
+// per line, or from $GITHUB_ACCESS_TOKENS, separated by commas. Blank lines
+// and comments starting with # are ignored.
+func readTokensFile() ([]string, error) {
+	if tokensFile == "" {
+		var tokens []string
+		for _, token := range strings.Split(os.Getenv("GITHUB_ACCESS_TOKENS"), ",") {
+			if token = strings.TrimSpace(token); token != "" {
+				tokens = append(tokens, token)
+			}
+		}
+		return tokens, nil
+	}
+
+	b, err := ioutil.ReadFile(tokensFile)
+	if err != nil {
+		return nil, errors.Wrap(err, "read tokens file failed")
+	}
+	var tokens []string
+	for _, line := range strings.Split(string(b), "\n") {
+		if line = strings.TrimSpace(line); line != "" && !strings.HasPrefix(line, "#") {
+			tokens = append(tokens, line)
+		}
+	}
+	return tokens, nil
+}
+
+// readTokenFile reads the access token from -token-file, if it is set.
+func readTokenFile() (string, error) {
+	if tokenFile == "" {
+		return "", nil
+	}
+	b, err := ioutil.ReadFile(tokenFile)
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimSpace(string(b)), nil
+}
+
+// gitCredentialTimeout is how long git credential fill may take.
+const gitCredentialTimeout = 10 * time.Second
+
+// gitCredential asks the git credential helpers for the password of the
+// host, which is the access token for Github. The user is never prompted,
+// and no token is returned if git is not installed or has no helper for
+// the host.
+func gitCredential(host string) (string, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), gitCredentialTimeout)
+	defer cancel()
+
+	cmd := exec.CommandContext(ctx, "git", "credential", "fill")
+	cmd.Stdin = strings.NewReader("protocol=https\nhost=" + credentialHost(host) + "\n\n")
+	cmd.Env = append(os.Environ(), "GIT_TERMINAL_PROMPT=0", "GIT_ASKPASS=", "SSH_ASKPASS=")
+	out, err := cmd.Output()
+	if err != nil {
+		return "", nil
+	}
+
+	scanner := bufio.NewScanner(bytes.NewReader(out))
+	for scanner.Scan() {
+		if v := strings.TrimPrefix(scanner.Text(), "password="); v != scanner.Text() {
+			return v, nil
+		}
+	}
+	return "", nil
+}
+
+// ghConfigDir returns the configuration directory of the gh CLI.
+func ghConfigDir() string {
+	if dir := os.Getenv("GH_CONFIG_DIR"); dir != "" {
+		return dir
+	}
+	if dir := os.Getenv("XDG_CONFIG_HOME"); dir != "" {
+		return filepath.Join(dir, "gh")
+	}
+	return filepath.Join(os.Getenv("HOME"), ".config", "gh")
+}
+
+// ghToken reads the token of the host from the hosts.yml file of the gh CLI,
+// which looks like:
+//
+//	github.com:
+//	    user: octocat
+//	    oauth_token: gho_xxx
+//
+// Only this simple form is understood. Tokens which gh keeps in the system
+// keyring are not found.
+func ghToken(host string) (string, error) {
+	f, err := os.Open(filepath.Join(ghConfigDir(), "hosts.yml"))
+	if os.IsNotExist(err) {
+		return "", nil
+	} else if err != nil {
+		return "", err
+	}
+	defer f.Close()
+
+	want := credentialHost(host)
+	current := ""
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := scanner.Text()
+		trimmed := strings.TrimSpace(line)
+		if trimmed == "" || strings.HasPrefix(trimmed, "#") {
+			continue
+		}
+
+		// Hosts are the top level keys.
+		if line[0] != ' ' && line[0] != '\t' {
+			current = strings.Trim(strings.TrimSuffix(trimmed, ":"), `"'`)
+			continue
+		}
+
+		if current == want && strings.HasPrefix(trimmed, "oauth_token:") {
+			token := strings.TrimSpace(strings.TrimPrefix(trimmed, "oauth_token:"))
+			return strings.Trim(token, `"'`), nil
+		}
+	}
+	return "", scanner.Err()
+}
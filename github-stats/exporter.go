@@ -0,0 +1,352 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"net/http"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/yuankunzhang/devops-challenge/github-stats/ghstats"
+)
+
+// repoGauges lists the fields exported as gauges of every repository,
+// besides the date of the latest commit.
+var repoGauges = []struct {
+	name  string
+	field string
+	help  string
+}{
+	{"github_repo_stars", "stars", "Number of stargazers of the repository."},
+	{"github_repo_forks", "forks", "Number of forks of the repository."},
+	{"github_repo_watchers", "watchers", "Number of watchers of the repository."},
+	{"github_repo_open_issues", "openIssues", "Number of open issues of the repository."},
+	{"github_repo_open_pull_requests", "openPRs", "Number of open pull requests of the repository."},
+	{"github_repo_archived", "isArchived", "Whether the repository is archived (1) or not (0)."},
+}
+
+// exporterFields returns the fields queried by the exporter.
+func exporterFields() []*ghstats.Field {
+	fields := make([]*ghstats.Field, len(repoGauges))
+	for i, g := range repoGauges {
+		fields[i] = ghstats.LookupField(g.field)
+	}
+	return fields
+}
+
+// exporter queries the repositories of a file periodically, and serves
+// their stats, along with its own health, as Prometheus metrics.
+type exporter struct {
+	hosts *hostClients
+	repos string
+
+	// latency holds the latency of the requests, by endpoint.
+	latency *histogram
+
+	mu sync.Mutex
+
+	// stats holds the results of the last run.
+	stats []*ghstats.RepoStats
+
+	// errors counts the errors of all the runs, by class.
+	errors map[string]int
+
+	// lastRun is when the last run completed, and lastDuration how long
+	// it took. results counts the repositories of the last run, by
+	// result: succeeded, failed or skipped.
+	lastRun      time.Time
+	lastDuration time.Duration
+	results      map[string]int
+}
+
+func newExporter(repos string) *exporter {
+	return &exporter{
+		repos:   repos,
+		latency: newHistogram("endpoint", latencyBuckets),
+		errors:  make(map[string]int),
+		results: make(map[string]int),
+	}
+}
+
+// run queries the repositories every interval, until ctx is done. A run
+// is given at most interval to complete.
+func (e *exporter) run(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		runCtx, cancel := context.WithTimeout(ctx, interval)
+		e.collect(runCtx)
+		cancel()
+
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// collect queries the repositories of the file once. The file is read on
+// every run, so that it can be changed without a restart. The stats of the
+// previous run are kept if the file can not be read.
+func (e *exporter) collect(ctx context.Context) {
+	start := time.Now()
+
+	f, err := os.Open(e.repos)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, errors.Wrap(err, "read repositories failed"))
+		e.mu.Lock()
+		e.errors[ghstats.Classify(err).String()]++
+		e.mu.Unlock()
+		return
+	}
+	defer f.Close()
+
+	in, ie := ghstats.Input(ctx, f, e.hosts.querier, ghstats.InputOptions{
+		DefaultBranch: defaultBranch,
+		Expand:        ghstats.OwnerFilter{Visibility: ghstats.Visibilities[0]},
+	})
+	out, qe := ghstats.Query(ctx, e.hosts.querier, in, ghstats.QueryOptions{
+		Concurrency: concurrency,
+		BatchSize:   batchSize,
+		GracePeriod: gracePeriod,
+	})
+
+	var stats []*ghstats.RepoStats
+	results := make(map[string]int)
+	errs := make(map[string]int)
+	for out != nil || ie != nil || qe != nil {
+		select {
+		case s, ok := <-out:
+			if !ok {
+				out = nil
+				continue
+			}
+			stats = append(stats, s)
+			results["succeeded"]++
+
+		case err, ok := <-ie:
+			if !ok {
+				ie = nil
+				continue
+			}
+			if ghstats.IsSkipped(err.Err) {
+				results["skipped"]++
+				continue
+			}
+			results["failed"]++
+			errs[ghstats.Classify(err.Err).String()]++
+
+		case err, ok := <-qe:
+			if !ok {
+				qe = nil
+				continue
+			}
+			if ghstats.IsSkipped(err.Err) {
+				results["skipped"]++
+				continue
+			}
+			results["failed"]++
+			errs[ghstats.Classify(err.Err).String()]++
+			if showError {
+				fmt.Fprintf(os.Stderr, "%s: %s\n", err.Input, err.Err)
+			}
+		}
+	}
+
+	// Export the repositories in a stable order, rather than in the order
+	// the queries completed.
+	sort.Slice(stats, func(i, j int) bool {
+		if a, b := repoLabel(stats[i]), repoLabel(stats[j]); a != b {
+			return a < b
+		}
+		return stats[i].Branch < stats[j].Branch
+	})
+
+	// An input without a branch and one naming the default branch query
+	// the same branch, which is exported once.
+	unique := stats[:0]
+	for i, s := range stats {
+		if i > 0 && repoLabel(s) == repoLabel(stats[i-1]) && s.Branch == stats[i-1].Branch {
+			continue
+		}
+		unique = append(unique, s)
+	}
+	stats = unique
+
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	e.stats = stats
+	e.results = results
+	for class, n := range errs {
+		e.errors[class] += n
+	}
+	e.lastRun = time.Now()
+	e.lastDuration = e.lastRun.Sub(start)
+}
+
+// repoLabel returns the repo label of a result, which is $orgname/$repo, or
+// $host/$orgname/$repo for another host than the default one.
+func repoLabel(stats *ghstats.RepoStats) string {
+	return strings.TrimPrefix(ghstats.URLKey(stats.URL), credentialHost("")+"/")
+}
+
+// gaugeValue returns the value of a field as a number.
+func gaugeValue(v interface{}) (float64, bool) {
+	switch v := v.(type) {
+	case nil:
+		return 0, false
+	case bool:
+		if v {
+			return 1, true
+		}
+		return 0, true
+	}
+	f, err := strconv.ParseFloat(ghstats.FormatValue(v), 64)
+	return f, err == nil
+}
+
+// metrics returns the metrics of the repositories and of the exporter.
+func (e *exporter) metrics() []*metric {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	commit := newMetric("github_repo_last_commit_timestamp_seconds", "gauge", "Date of the latest commit of the branch.")
+	gauges := make([]*metric, len(repoGauges))
+	for i, g := range repoGauges {
+		gauges[i] = newMetric(g.name, "gauge", g.help)
+	}
+	for _, stats := range e.stats {
+		repo := repoLabel(stats)
+		if !stats.CommitTime.IsZero() {
+			commit.add(float64(stats.CommitTime.Unix()), "repo", repo, "branch", stats.Branch)
+		}
+		for i, g := range repoGauges {
+			if v, ok := gaugeValue(stats.Values[g.field]); ok {
+				gauges[i].add(v, "repo", repo, "branch", stats.Branch)
+			}
+		}
+	}
+
+	remaining := newMetric("github_stats_rate_limit_remaining", "gauge", "Rate limit points remaining, as of the latest response.")
+	reset := newMetric("github_stats_rate_limit_reset_timestamp_seconds", "gauge", "Date of the next rate limit reset.")
+	var endpoints []string
+	clients := make(map[string]*ghstats.Client)
+	e.hosts.each(func(endpoint string, c *ghstats.Client) {
+		endpoints = append(endpoints, endpoint)
+		clients[endpoint] = c
+	})
+	sort.Strings(endpoints)
+	for _, endpoint := range endpoints {
+		if n, resetAt, known := clients[endpoint].RateLimit(); known {
+			remaining.add(float64(n), "endpoint", endpoint)
+			reset.add(float64(resetAt.Unix()), "endpoint", endpoint)
+		}
+	}
+
+	errs := newMetric("github_stats_errors_total", "counter", "Number of failed repositories, by error class.")
+	classes := make([]string, 0, len(e.errors))
+	for class := range e.errors {
+		classes = append(classes, class)
+	}
+	sort.Strings(classes)
+	for _, class := range classes {
+		errs.add(float64(e.errors[class]), "class", class)
+	}
+
+	results := newMetric("github_stats_last_run_repositories", "gauge", "Number of repositories of the last run, by result.")
+	for _, result := range []string{"succeeded", "failed", "skipped"} {
+		results.add(float64(e.results[result]), "result", result)
+	}
+	lastRun := newMetric("github_stats_last_run_timestamp_seconds", "gauge", "Date of the completion of the last run.")
+	lastDuration := newMetric("github_stats_last_run_duration_seconds", "gauge", "Duration of the last run.")
+	if !e.lastRun.IsZero() {
+		lastRun.add(float64(e.lastRun.Unix()))
+		lastDuration.add(e.lastDuration.Seconds())
+	}
+
+	metrics := append([]*metric{commit}, gauges...)
+	return append(metrics,
+		remaining,
+		reset,
+		e.latency.metric("github_stats_query_duration_seconds", "Latency of the requests to the API."),
+		errs,
+		results,
+		lastRun,
+		lastDuration,
+	)
+}
+
+// handleMetrics serves GET /metrics.
+func (e *exporter) handleMetrics(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeError(w, http.StatusMethodNotAllowed, errors.New("method not allowed"))
+		return
+	}
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	writeMetrics(w, e.metrics())
+}
+
+// export runs the exporter command, which queries the repositories of a
+// file periodically and serves their stats as Prometheus metrics until it
+// is interrupted.
+func export(args []string) {
+	fs := flag.NewFlagSet("exporter", flag.ExitOnError)
+	registerClientFlags(fs)
+	listen := fs.String("listen", ":9101", "address to listen on")
+	repos := fs.String("repos", "", "file listing the repositories to export, one per line")
+	interval := fs.Duration("interval", 5*time.Minute, "interval between two runs")
+	fs.IntVar(&batchSize, "batch", 1, "number of repositories queried per request")
+	fs.BoolVar(&showError, "e", false, "show errors")
+	fs.Parse(args)
+	setClientDefaults()
+
+	if *repos == "" || *interval <= 0 {
+		fmt.Fprintln(os.Stderr, "-repos and a positive -interval are required")
+		os.Exit(2)
+	}
+
+	e := newExporter(*repos)
+	hosts, err := newHosts(exporterFields(), func(endpoint string, d time.Duration) {
+		e.latency.observe(endpoint, d.Seconds())
+	})
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(startupExitCode(err))
+	}
+	e.hosts = hosts
+
+	ctx, cancel := withSignals(context.Background())
+	defer cancel()
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/metrics", e.handleMetrics)
+	mux.HandleFunc("/healthz", func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, http.StatusOK, map[string]string{"status": "ok"})
+	})
+	srv := &http.Server{Addr: *listen, Handler: mux}
+
+	// Stop the runs and the server once interrupted, and give the
+	// requests in flight the grace period to complete.
+	stopped := make(chan struct{})
+	go func() {
+		defer close(stopped)
+		e.run(ctx, *interval)
+		shutdownCtx, cancel := context.WithTimeout(context.Background(), gracePeriod)
+		defer cancel()
+		srv.Shutdown(shutdownCtx)
+	}()
+
+	fmt.Fprintf(os.Stderr, "listening on %s\n", *listen)
+	if err := srv.ListenAndServe(); err != http.ErrServerClosed {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+	<-stopped
+}
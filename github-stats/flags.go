@@ -0,0 +1,103 @@
+package main
+
+import (
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/yuankunzhang/devops-challenge/github-stats/ghstats"
+)
+
+// formatFlag is a flag.Value which only accepts one of the formats.
+type formatFlag string
+
+func (f *formatFlag) String() string {
+	return string(*f)
+}
+
+func (f *formatFlag) Set(s string) error {
+	for _, format := range ghstats.Formats {
+		if s == format {
+			*f = formatFlag(s)
+			return nil
+		}
+	}
+	return errors.Errorf("should be one of %s", strings.Join(ghstats.Formats, "|"))
+}
+
+// sortFlag is a flag.Value which only accepts one of the sort keys.
+type sortFlag string
+
+func (f *sortFlag) String() string {
+	return string(*f)
+}
+
+func (f *sortFlag) Set(s string) error {
+	for _, key := range ghstats.SortKeys {
+		if s == key {
+			*f = sortFlag(s)
+			return nil
+		}
+	}
+	return errors.Errorf("should be one of %s", strings.Join(ghstats.SortKeys, "|"))
+}
+
+// visibilityFlag is a flag.Value which only accepts one of the visibilities.
+type visibilityFlag string
+
+func (f *visibilityFlag) String() string {
+	return string(*f)
+}
+
+func (f *visibilityFlag) Set(s string) error {
+	for _, v := range ghstats.Visibilities {
+		if s == v {
+			*f = visibilityFlag(s)
+			return nil
+		}
+	}
+	return errors.Errorf("should be one of %s", strings.Join(ghstats.Visibilities, "|"))
+}
+
+// fieldsFlag is a flag.Value which accepts a comma separated list of field
+// names.
+type fieldsFlag []*ghstats.Field
+
+func (f *fieldsFlag) String() string {
+	var names []string
+	for _, field := range *f {
+		names = append(names, field.Name())
+	}
+	return strings.Join(names, ",")
+}
+
+func (f *fieldsFlag) Set(s string) error {
+	fields, err := ghstats.ParseFields(s)
+	if err != nil {
+		return err
+	}
+	*f = fields
+	return nil
+}
+
+// ageFlag is a flag.Value which accepts a duration in days or weeks as
+// well, see ghstats.ParseAge.
+type ageFlag time.Duration
+
+func (f *ageFlag) String() string {
+	d := time.Duration(*f)
+	if d > 0 && d%(24*time.Hour) == 0 {
+		return strconv.Itoa(int(d/(24*time.Hour))) + "d"
+	}
+	return d.String()
+}
+
+func (f *ageFlag) Set(s string) error {
+	d, err := ghstats.ParseAge(s)
+	if err != nil {
+		return err
+	}
+	*f = ageFlag(d)
+	return nil
+}
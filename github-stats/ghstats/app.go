@@ -0,0 +1,199 @@
+package ghstats
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+	"golang.org/x/oauth2"
+)
+
+const (
+	// jwtLifetime is the lifetime of the JWTs authenticating as the app.
+	// Github rejects JWTs valid for more than 10 minutes.
+	jwtLifetime = 9 * time.Minute
+
+	// clockSkew is how far the clock of the Github server may be behind
+	// ours.
+	clockSkew = time.Minute
+
+	// refreshMargin is how long before their expiry the installation
+	// tokens are refreshed, so that no request is sent with a token about
+	// to expire.
+	refreshMargin = 5 * time.Minute
+)
+
+// appTokenSource is an oauth2.TokenSource which authenticates as a Github
+// App installation. It mints a JWT signed with the private key of the app,
+// and exchanges it for an installation token. It should be wrapped with
+// oauth2.ReuseTokenSource, so that the token is only refreshed when it
+// expires.
+type appTokenSource struct {
+	appID string
+	key   *rsa.PrivateKey
+
+	// installationID is the installation to get tokens for. If it is 0,
+	// the app should be installed exactly once, and that installation is
+	// used.
+	installationID int64
+
+	// apiURL is the root of the REST API, which issues the tokens.
+	apiURL string
+
+	httpClient *http.Client
+}
+
+// NewAppTokenSource returns the token source of a Github App installation,
+// given the app ID and the PEM encoded private key of the app. The tokens
+// are issued by the REST API of the given GraphQL endpoint.
+func NewAppTokenSource(appID string, keyPEM []byte, installationID int64, endpoint string, httpClient *http.Client) (oauth2.TokenSource, error) {
+	key, err := parsePrivateKey(keyPEM)
+	if err != nil {
+		return nil, err
+	}
+	src := &appTokenSource{
+		appID:          appID,
+		key:            key,
+		installationID: installationID,
+		apiURL:         restURL(endpoint),
+		httpClient:     httpClient,
+	}
+	return oauth2.ReuseTokenSource(nil, src), nil
+}
+
+// parsePrivateKey parses a PEM encoded RSA private key, in either the PKCS#1
+// form Github generates or the PKCS#8 form.
+func parsePrivateKey(keyPEM []byte) (*rsa.PrivateKey, error) {
+	block, _ := pem.Decode(keyPEM)
+	if block == nil {
+		return nil, errors.New("invalid private key: no PEM data found")
+	}
+	if key, err := x509.ParsePKCS1PrivateKey(block.Bytes); err == nil {
+		return key, nil
+	}
+	parsed, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+	if err != nil {
+		return nil, errors.Wrap(err, "invalid private key")
+	}
+	key, ok := parsed.(*rsa.PrivateKey)
+	if !ok {
+		return nil, errors.New("invalid private key: not an RSA key")
+	}
+	return key, nil
+}
+
+// restURL returns the root of the REST API which goes along with a GraphQL
+// endpoint: https://api.github.com for github.com, and
+// https://$host/api/v3 for a Github Enterprise Server.
+func restURL(endpoint string) string {
+	if strings.HasSuffix(endpoint, "/api/graphql") {
+		return strings.TrimSuffix(endpoint, "/graphql") + "/v3"
+	}
+	return strings.TrimSuffix(endpoint, "/graphql")
+}
+
+// jwt returns a JWT authenticating as the app, signed with RS256.
+func (s *appTokenSource) jwt() (string, error) {
+	now := time.Now()
+	header, _ := json.Marshal(map[string]string{"alg": "RS256", "typ": "JWT"})
+	claims, _ := json.Marshal(map[string]interface{}{
+		"iat": now.Add(-clockSkew).Unix(),
+		"exp": now.Add(jwtLifetime).Unix(),
+		"iss": s.appID,
+	})
+
+	enc := base64.RawURLEncoding
+	unsigned := enc.EncodeToString(header) + "." + enc.EncodeToString(claims)
+
+	digest := sha256.Sum256([]byte(unsigned))
+	sig, err := rsa.SignPKCS1v15(rand.Reader, s.key, crypto.SHA256, digest[:])
+	if err != nil {
+		return "", errors.Wrap(err, "sign JWT failed")
+	}
+	return unsigned + "." + enc.EncodeToString(sig), nil
+}
+
+// call sends a request to the REST API authenticated as the app, and
+// decodes the response into out.
+func (s *appTokenSource) call(method, path string, out interface{}) error {
+	jwt, err := s.jwt()
+	if err != nil {
+		return err
+	}
+
+	req, err := http.NewRequest(method, s.apiURL+path, nil)
+	if err != nil {
+		return errors.Wrap(err, "create request failed")
+	}
+	req.Header.Set("Authorization", "Bearer "+jwt)
+	req.Header.Set("Accept", "application/vnd.github+json")
+
+	resp, err := s.httpClient.Do(req)
+	if err != nil {
+		return &classifiedError{class: ClassNetworkError, err: errors.Wrap(err, "app authentication failed")}
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode/100 != 2 {
+		body, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 4096))
+		e := &classifiedError{
+			class: ClassUnauthorized,
+			err:   errors.Errorf("app authentication failed: %s %s: %s", resp.Status, path, bytes.TrimSpace(body)),
+		}
+		if resp.StatusCode >= 500 {
+			e.class = ClassServerError
+		}
+		return e
+	}
+
+	if err := json.NewDecoder(resp.Body).Decode(out); err != nil {
+		return errors.Wrap(err, "json decode failed")
+	}
+	return nil
+}
+
+// Token returns a new installation token.
+func (s *appTokenSource) Token() (*oauth2.Token, error) {
+	if s.installationID == 0 {
+		var installations []struct {
+			ID int64 `json:"id"`
+		}
+		if err := s.call(http.MethodGet, "/app/installations", &installations); err != nil {
+			return nil, err
+		}
+		if len(installations) != 1 {
+			return nil, &classifiedError{
+				class: ClassUnauthorized,
+				err:   errors.Errorf("app authentication failed: the app has %d installations, the installation ID should be set", len(installations)),
+			}
+		}
+		s.installationID = installations[0].ID
+	}
+
+	var out struct {
+		Token     string    `json:"token"`
+		ExpiresAt time.Time `json:"expires_at"`
+	}
+	path := fmt.Sprintf("/app/installations/%d/access_tokens", s.installationID)
+	if err := s.call(http.MethodPost, path, &out); err != nil {
+		return nil, err
+	}
+
+	return &oauth2.Token{
+		AccessToken: out.Token,
+		Expiry:      out.ExpiresAt.Add(-refreshMargin),
+	}, nil
+}
@@ -0,0 +1,124 @@
+package ghstats
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// Cache stores the responses of the GraphQL API on disk, so that a run
+// repeated within the TTL doesn't issue the same queries again. Every
+// response is stored in its own file, named after the hash of the endpoint,
+// the credential it was fetched with and the query, so that a response is
+// never served to other credentials, which may not see the same data.
+// Files are written to a temporary name and renamed, so the cache is safe
+// to use from concurrent workers, and concurrent runs. A nil cache never
+// hits.
+type Cache struct {
+	dir string
+	ttl time.Duration
+}
+
+// DefaultCacheDir returns the directory of the cache, in the user cache
+// directory.
+func DefaultCacheDir() string {
+	dir := os.Getenv("XDG_CACHE_HOME")
+	if dir == "" {
+		dir = filepath.Join(os.Getenv("HOME"), ".cache")
+	}
+	return filepath.Join(dir, "github-stats")
+}
+
+// NewCache returns the cache of the responses in dir, which are reused for
+// ttl. It returns nil, which disables caching, if dir or ttl is not set.
+func NewCache(dir string, ttl time.Duration) *Cache {
+	if dir == "" || ttl <= 0 {
+		return nil
+	}
+	return &Cache{dir: dir, ttl: ttl}
+}
+
+// path returns the file of the response to a query sent to an endpoint with
+// a credential.
+func (c *Cache) path(endpoint, credential string, body []byte) string {
+	h := sha256.New()
+	h.Write([]byte(endpoint))
+	h.Write([]byte{0})
+	h.Write([]byte(credential))
+	h.Write([]byte{0})
+	h.Write(body)
+	key := hex.EncodeToString(h.Sum(nil))
+	return filepath.Join(c.dir, key[:2], key+".json")
+}
+
+// get returns the cached response to a query, if it is younger than the
+// TTL.
+func (c *Cache) get(endpoint, credential string, body []byte) (*QueryResult, bool) {
+	if c == nil {
+		return nil, false
+	}
+
+	p := c.path(endpoint, credential, body)
+	fi, err := os.Stat(p)
+	if err != nil || time.Since(fi.ModTime()) > c.ttl {
+		return nil, false
+	}
+	b, err := ioutil.ReadFile(p)
+	if err != nil {
+		return nil, false
+	}
+
+	var out QueryResult
+	if err := json.Unmarshal(b, &out); err != nil {
+		return nil, false
+	}
+	out.cached = true
+	return &out, true
+}
+
+// cachedErrorTypes are the types of the GraphQL errors which are cached
+// along with the response, as they are not transient. A response with any
+// other error is not cached, so that a hiccup is not replayed until it
+// expires.
+var cachedErrorTypes = map[string]bool{"NOT_FOUND": true, "FORBIDDEN": true}
+
+// put stores the response to a query. Failures are ignored, the response
+// is just not cached then.
+func (c *Cache) put(endpoint, credential string, body []byte, out *QueryResult) {
+	if c == nil {
+		return
+	}
+	for _, e := range out.Errors {
+		if !cachedErrorTypes[e.Type] {
+			return
+		}
+	}
+
+	b, err := json.Marshal(out)
+	if err != nil {
+		return
+	}
+
+	p := c.path(endpoint, credential, body)
+	if err := os.MkdirAll(filepath.Dir(p), 0700); err != nil {
+		return
+	}
+	tmp, err := ioutil.TempFile(filepath.Dir(p), ".tmp-")
+	if err != nil {
+		return
+	}
+	_, err = tmp.Write(b)
+	if cerr := tmp.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = os.Rename(tmp.Name(), p)
+	}
+	if err != nil {
+		os.Remove(tmp.Name())
+	}
+}
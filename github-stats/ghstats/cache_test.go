@@ -0,0 +1,50 @@
+package ghstats_test
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/yuankunzhang/devops-challenge/github-stats/ghstats"
+	"github.com/yuankunzhang/devops-challenge/github-stats/ghstats/ghstatstest"
+)
+
+func TestCacheCredentials(t *testing.T) {
+	srv := ghstatstest.NewServer(testRepos...)
+	defer srv.Close()
+	dir, err := ioutil.TempDir("", "ghstats")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	cache := ghstats.NewCache(dir, time.Hour)
+
+	tests := []struct {
+		opts       ghstats.Options
+		wantCached bool
+	}{
+		{ghstats.Options{Credential: "token a"}, false},
+		{ghstats.Options{Credential: "token a"}, true},
+		{ghstats.Options{Credential: "token b"}, false},
+		{ghstats.Options{}, false},
+		// The responses of the pool are keyed by the token of each query.
+		{ghstats.Options{Tokens: []string{"pool-a"}}, false},
+		{ghstats.Options{Tokens: []string{"pool-a"}}, true},
+		{ghstats.Options{Tokens: []string{"pool-b"}}, false},
+	}
+
+	for i, tt := range tests {
+		tt.opts.Cache = cache
+		client := ghstats.NewClient(nil, srv.Endpoint(), tt.opts)
+		if _, err := client.Query(context.Background(), "octo", "alpha", ""); err != nil {
+			t.Fatalf("query %d failed: %s", i, err)
+		}
+		// Only the queries which were sent report the rate limit.
+		_, _, known := client.RateLimit()
+		if cached := !known; cached != tt.wantCached {
+			t.Errorf("query %d with %+v: cached %t, want %t", i, tt.opts, cached, tt.wantCached)
+		}
+	}
+}
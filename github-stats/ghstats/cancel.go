@@ -0,0 +1,54 @@
+package ghstats
+
+import (
+	"context"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// cancelledError is returned for the queries which were not issued, or not
+// completed within the grace period, because the run was interrupted or
+// reached its deadline.
+type cancelledError struct {
+	cause error
+}
+
+func (e *cancelledError) Error() string {
+	if e.cause == context.DeadlineExceeded {
+		return "query skipped: deadline exceeded"
+	}
+	return "query skipped: interrupted"
+}
+
+// IsSkipped reports whether err means that the query was skipped, rather
+// than failed.
+func IsSkipped(err error) bool {
+	switch errors.Cause(err).(type) {
+	case *budgetError, *cancelledError:
+		return true
+	}
+	return false
+}
+
+// withGrace returns a context which is not cancelled along with ctx, but
+// the given grace period later. It is used for the in-flight queries, which
+// are allowed to complete after the run is cancelled.
+func withGrace(ctx context.Context, grace time.Duration) (context.Context, context.CancelFunc) {
+	graceCtx, cancel := context.WithCancel(context.Background())
+	go func() {
+		select {
+		case <-ctx.Done():
+		case <-graceCtx.Done():
+			return
+		}
+		timer := time.NewTimer(grace)
+		defer timer.Stop()
+		select {
+		case <-timer.C:
+			cancel()
+		case <-graceCtx.Done():
+		}
+	}()
+	return graceCtx, cancel
+}
@@ -0,0 +1,295 @@
+package ghstats
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/csv"
+	"encoding/json"
+	"io/ioutil"
+	"sort"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// exitChanges is the exit code of a diff run which detected changes, and
+// had no failures.
+const exitChanges = 10
+
+// statuses lists the statuses of the repositories in a diff run.
+var statuses = []string{"added", "changed", "unchanged", "removed", "error"}
+
+// statusField is the column holding the status of the repositories in a
+// diff run. It is not queried, so it is not part of fieldRegistry.
+var statusField = &Field{name: "status", header: "Status"}
+
+// comparedFieldNames are the fields a result is compared with the previous
+// run by, see Differ.result.
+var comparedFieldNames = []string{"lastCommit.date", "lastCommit.author"}
+
+// Snapshot holds the results of a previous run, keyed by the URL of the
+// repositories, see URLKey. The values are keyed by the field names.
+type Snapshot map[string]map[string]interface{}
+
+// LoadSnapshot reads the output of a previous run, in the csv, json or
+// ndjson format. The format is guessed from the content. The repositories
+// which were removed or failed in the previous run, if it was a diff run as
+// well, are left out.
+func LoadSnapshot(path string) (Snapshot, error) {
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, errors.Wrap(err, "read previous run failed")
+	}
+
+	var records []map[string]interface{}
+	trimmed := bytes.TrimSpace(b)
+	if bytes.HasPrefix(trimmed, []byte("{")) {
+		records, err = readJSONRecords(trimmed)
+	} else {
+		records, err = readCSVRecords(trimmed)
+	}
+	if err != nil {
+		return nil, errors.Wrapf(err, "invalid previous run %s", path)
+	}
+
+	s := make(Snapshot)
+	for i, values := range records {
+		status := FormatValue(values["status"])
+		if status == "removed" || status == "error" {
+			continue
+		}
+		// The repositories are matched by their URL, so the previous run
+		// must have output it.
+		key := URLKey(FormatValue(values["url"]))
+		if key == "" {
+			return nil, errors.Errorf("invalid previous run %s: result %d has no %q field", path, i+1, "url")
+		}
+		// Without the fields compared, every repository would look
+		// changed. They may be empty, e.g. for an empty repository.
+		for _, name := range comparedFieldNames {
+			if _, ok := values[name]; !ok {
+				return nil, errors.Errorf("invalid previous run %s: result %d has no %q field", path, i+1, name)
+			}
+		}
+		s[key] = values
+	}
+	return s, nil
+}
+
+// normalizeValues converts the lists of a decoded JSON result to the type
+// of the list fields, []string.
+func normalizeValues(record map[string]interface{}) {
+	for k, v := range record {
+		list, ok := v.([]interface{})
+		if !ok {
+			continue
+		}
+		values := make([]string, len(list))
+		for i, elem := range list {
+			values[i] = FormatValue(elem)
+		}
+		record[k] = values
+	}
+}
+
+// readJSONRecords reads the results of the json or the ndjson format.
+func readJSONRecords(b []byte) ([]map[string]interface{}, error) {
+	var doc struct {
+		Results []map[string]interface{} `json:"results"`
+	}
+	if err := json.Unmarshal(b, &doc); err == nil && doc.Results != nil {
+		for _, record := range doc.Results {
+			normalizeValues(record)
+		}
+		return doc.Results, nil
+	}
+
+	var records []map[string]interface{}
+	scanner := bufio.NewScanner(bytes.NewReader(b))
+	scanner.Buffer(nil, 1<<20)
+	for scanner.Scan() {
+		line := bytes.TrimSpace(scanner.Bytes())
+		if len(line) == 0 {
+			continue
+		}
+		var record map[string]interface{}
+		if err := json.Unmarshal(line, &record); err != nil {
+			return nil, err
+		}
+		if record["type"] == "result" {
+			normalizeValues(record)
+			records = append(records, record)
+		}
+	}
+	return records, scanner.Err()
+}
+
+// readCSVRecords reads the results of the csv format, which may be followed
+// by the errors and the summary. The columns are matched with the fields by
+// their headers. Empty values are kept, so that the fields of every record
+// are the columns.
+func readCSVRecords(b []byte) ([]map[string]interface{}, error) {
+	// The errors and the summary are separated by blank lines.
+	if i := bytes.Index(b, []byte("\n\n")); i >= 0 {
+		b = b[:i]
+	}
+
+	r := csv.NewReader(bytes.NewReader(b))
+	rows, err := r.ReadAll()
+	if err != nil || len(rows) == 0 {
+		return nil, err
+	}
+
+	names := make([]string, len(rows[0]))
+	for i, header := range rows[0] {
+		if header == statusField.header {
+			names[i] = statusField.name
+		}
+		for _, f := range fieldRegistry {
+			if f.header == header {
+				names[i] = f.name
+			}
+		}
+	}
+
+	var records []map[string]interface{}
+	for _, row := range rows[1:] {
+		record := make(map[string]interface{})
+		for i, v := range row {
+			if names[i] != "" {
+				record[names[i]] = v
+			}
+		}
+		records = append(records, record)
+	}
+	return records, nil
+}
+
+// URLKey returns the key of a repository given its URL, which is the host
+// and the path in lower case, e.g. github.com/octocat/hello-world.
+func URLKey(url string) string {
+	if i := strings.Index(url, "://"); i >= 0 {
+		url = url[i+3:]
+	}
+	return strings.ToLower(strings.TrimSuffix(url, "/"))
+}
+
+// repoKey returns the key of the repository of an input. defaultHost is the
+// host of the inputs which don't name one, e.g. github.com.
+func repoKey(ref RepoRef, defaultHost string) string {
+	host := ref.Host
+	if host == "" {
+		host = defaultHost
+	}
+	return strings.ToLower(host + "/" + ref.Owner + "/" + ref.Name)
+}
+
+// ownerKey returns the host/owner part of the key of a repository.
+func ownerKey(key string) string {
+	if i := strings.LastIndex(key, "/"); i >= 0 {
+		return key[:i]
+	}
+	return key
+}
+
+// Differ compares the results of a run with a snapshot, and sets their
+// status.
+type Differ struct {
+	prev Snapshot
+
+	// defaultHost is the host of the inputs which don't name one.
+	defaultHost string
+
+	// seen holds the keys of the repositories of this run.
+	seen map[string]bool
+
+	// unexpanded holds the hosts and owners, as host/owner keys, whose
+	// repositories could not be listed.
+	unexpanded map[string]bool
+}
+
+// NewDiffer returns a Differ comparing the results with prev. defaultHost is
+// the host of the inputs which don't name one, e.g. github.com.
+func NewDiffer(prev Snapshot, defaultHost string) *Differ {
+	return &Differ{prev: prev, defaultHost: defaultHost, seen: make(map[string]bool), unexpanded: make(map[string]bool)}
+}
+
+// result sets the status of a result, which is added, changed or
+// unchanged. A repository has changed if its latest commit has a different
+// date or author.
+func (d *Differ) result(stats *RepoStats) string {
+	key := URLKey(stats.URL)
+	d.seen[key] = true
+
+	status := "unchanged"
+	if prev, ok := d.prev[key]; !ok {
+		status = "added"
+	} else if FormatValue(prev["lastCommit.date"]) != stats.CommitDate ||
+		FormatValue(prev["lastCommit.author"]) != stats.AuthorName {
+		status = "changed"
+	}
+	stats.Values[statusField.name] = status
+	return status
+}
+
+// failure returns the result standing for an input which failed. Its
+// values are the previous ones if the repository is in the snapshot.
+func (d *Differ) failure(input string) *RepoStats {
+	values := make(map[string]interface{})
+	if ref, err := ParseRepoRef(input, ""); err == nil {
+		key := repoKey(ref, d.defaultHost)
+		d.seen[key] = true
+		if prev, ok := d.prev[key]; ok {
+			for k, v := range prev {
+				values[k] = v
+			}
+		} else {
+			values["owner"] = ref.Owner
+			values["name"] = ref.Name
+		}
+	} else {
+		values["name"] = input
+	}
+	values[statusField.name] = "error"
+	return newRepoStats(values)
+}
+
+// skipped records an input which was skipped, so that it is not reported as
+// removed.
+func (d *Differ) skipped(input string) {
+	if ref, err := ParseRepoRef(input, ""); err == nil {
+		d.seen[repoKey(ref, d.defaultHost)] = true
+	}
+}
+
+// inputFailed records an input which failed before it was queried. If it
+// is an $orgname/* input, the repositories of the owner are unknown, so
+// they are not reported as removed.
+func (d *Differ) inputFailed(input string) {
+	if ref, err := ParseRepoRef(input, ""); err == nil && ref.IsWildcard() {
+		d.unexpanded[ownerKey(repoKey(ref, d.defaultHost))] = true
+	}
+}
+
+// removed returns the results standing for the repositories of the
+// snapshot which are missing from this run.
+func (d *Differ) removed() []*RepoStats {
+	var removed []*RepoStats
+	for key, prev := range d.prev {
+		if d.seen[key] || d.unexpanded[ownerKey(key)] {
+			continue
+		}
+		values := make(map[string]interface{})
+		for k, v := range prev {
+			values[k] = v
+		}
+		values[statusField.name] = "removed"
+		removed = append(removed, newRepoStats(values))
+	}
+
+	// Report them in the order of their keys, the map order is random.
+	sort.Slice(removed, func(i, j int) bool {
+		return URLKey(removed[i].URL) < URLKey(removed[j].URL)
+	})
+	return removed
+}
@@ -0,0 +1,81 @@
+package ghstats
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+)
+
+func TestLoadSnapshot(t *testing.T) {
+	dir, err := ioutil.TempDir("", "ghstats")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	tests := []struct {
+		name    string
+		content string
+		want    int
+		wantErr bool
+	}{
+		{
+			name:    "csv",
+			content: "Name,Clone URL,Date of Latest Commit,Name of Latest Author\nhello,https://github.com/octo/hello,2018-05-01T10:00:00Z,alice\nempty,https://github.com/octo/empty,,\n",
+			want:    2,
+		},
+		{
+			name:    "csv diff",
+			content: "Status,Name,Clone URL,Date of Latest Commit,Name of Latest Author\nchanged,hello,https://github.com/octo/hello,2018-05-01T10:00:00Z,alice\nremoved,gone,https://github.com/octo/gone,2018-05-01T10:00:00Z,bob\n",
+			want:    1,
+		},
+		{
+			name:    "json",
+			content: `{"results": [{"name": "hello", "url": "https://github.com/octo/hello", "lastCommit.date": null, "lastCommit.author": null}]}`,
+			want:    1,
+		},
+		{
+			name:    "ndjson",
+			content: `{"type": "result", "url": "https://github.com/octo/hello", "lastCommit.date": "2018-05-01T10:00:00Z", "lastCommit.author": "alice"}` + "\n" + `{"type": "summary", "total": 1}`,
+			want:    1,
+		},
+		{
+			name:    "no url",
+			content: "Name,Date of Latest Commit,Name of Latest Author\nhello,2018-05-01T10:00:00Z,alice\n",
+			wantErr: true,
+		},
+		{
+			name:    "no latest commit",
+			content: "Name,Clone URL,Stars\nhello,https://github.com/octo/hello,42\n",
+			wantErr: true,
+		},
+		{
+			name:    "no author",
+			content: `{"results": [{"url": "https://github.com/octo/hello", "lastCommit.date": "2018-05-01T10:00:00Z"}]}`,
+			wantErr: true,
+		},
+	}
+
+	for i, tt := range tests {
+		path := filepath.Join(dir, strconv.Itoa(i))
+		if err := ioutil.WriteFile(path, []byte(tt.content), 0600); err != nil {
+			t.Fatal(err)
+		}
+		s, err := LoadSnapshot(path)
+		if tt.wantErr {
+			if err == nil {
+				t.Errorf("%s: LoadSnapshot() = %v, want an error", tt.name, s)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: LoadSnapshot() failed: %s", tt.name, err)
+			continue
+		}
+		if len(s) != tt.want {
+			t.Errorf("%s: LoadSnapshot() = %v, want %d results", tt.name, s, tt.want)
+		}
+	}
+}
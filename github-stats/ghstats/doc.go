@@ -0,0 +1,13 @@
+// Package ghstats queries the properties of Github repositories through the
+// GraphQL API. It is the engine of the github-stats command.
+//
+// A Client queries batches of repositories, with the fields selected from
+// the registry (see DefaultFields and ParseFields), within its rate limit
+// budget, with retries of the transient errors and an optional disk cache.
+//
+// The command is a pipeline of three stages connected by channels, which are
+// exported as well: Input parses the lines of a reader into RepoRefs,
+// expanding $orgname/* and the search results, Query queries them
+// concurrently, and Output writes the results in one of the Formats and
+// returns the Report of the run.
+package ghstats
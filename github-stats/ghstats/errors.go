@@ -0,0 +1,247 @@
+package ghstats
+
+import (
+	"context"
+	"io"
+	"io/ioutil"
+	"math/rand"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// ErrorClass classifies the failures of queries.
+type ErrorClass int
+
+const (
+	ClassUnknown ErrorClass = iota
+	ClassNotFound
+	ClassUnauthorized
+	ClassForbidden
+	ClassRateLimited
+	ClassServerError
+	ClassNetworkError
+)
+
+var classNames = map[ErrorClass]string{
+	ClassUnknown:      "unknown",
+	ClassNotFound:     "not_found",
+	ClassUnauthorized: "unauthorized",
+	ClassForbidden:    "forbidden",
+	ClassRateLimited:  "rate_limited",
+	ClassServerError:  "server_error",
+	ClassNetworkError: "network_error",
+}
+
+func (c ErrorClass) String() string {
+	return classNames[c]
+}
+
+// exitCodes maps the error classes to the exit codes of the process. 2 is
+// used by the flag package for usage errors.
+var exitCodes = map[ErrorClass]int{
+	ClassUnknown:      1,
+	ClassNotFound:     3,
+	ClassUnauthorized: 4,
+	ClassForbidden:    5,
+	ClassRateLimited:  6,
+	ClassServerError:  7,
+	ClassNetworkError: 8,
+}
+
+// ExitCode returns the exit code of the process for a failure of the class.
+func (c ErrorClass) ExitCode() int {
+	return exitCodes[c]
+}
+
+// exitPriority orders the error classes when several of them occur in a
+// run: the exit code is the one of the first class which occurred. Classes
+// which concern the whole run come before the ones of single repositories,
+// and a repository which is gone comes before an invalid input line.
+var exitPriority = []ErrorClass{
+	ClassNetworkError,
+	ClassServerError,
+	ClassUnauthorized,
+	ClassRateLimited,
+	ClassForbidden,
+	ClassNotFound,
+	ClassUnknown,
+}
+
+// WithClass returns err classified as class, so that Classify returns class
+// for it.
+func WithClass(err error, class ErrorClass) error {
+	return &classifiedError{class: class, err: err}
+}
+
+// IsClassified reports whether err has been classified, as opposed to being
+// of the unknown class by default.
+func IsClassified(err error) bool {
+	_, ok := errors.Cause(err).(*classifiedError)
+	return ok
+}
+
+// classifiedError is an error along with its class.
+type classifiedError struct {
+	class ErrorClass
+	err   error
+
+	// secondary indicates whether a rate limited error was caused by the
+	// secondary (abuse) rate limits, rather than the rate limit budget.
+	secondary bool
+
+	// retryAfter is the delay the server asked for before retrying, if
+	// any.
+	retryAfter time.Duration
+}
+
+func (e *classifiedError) Error() string {
+	return e.err.Error()
+}
+
+// transient reports whether the query may succeed if it is retried.
+func (e *classifiedError) transient() bool {
+	switch e.class {
+	case ClassRateLimited, ClassServerError, ClassNetworkError:
+		return true
+	}
+	return false
+}
+
+// Classify returns the class of an error.
+func Classify(err error) ErrorClass {
+	switch e := errors.Cause(err).(type) {
+	case *classifiedError:
+		return e.class
+	case *branchNotFoundError:
+		return ClassNotFound
+	case *budgetError:
+		return ClassRateLimited
+	}
+	return ClassUnknown
+}
+
+// graphqlErrorClasses maps the type of GraphQL errors to the error classes.
+var graphqlErrorClasses = map[string]ErrorClass{
+	"NOT_FOUND":    ClassNotFound,
+	"FORBIDDEN":    ClassForbidden,
+	"RATE_LIMITED": ClassRateLimited,
+}
+
+// classifyGraphQLErrors returns the error for the GraphQL errors of a
+// response, which are all reported. Its class is the one of the first error
+// whose type is known.
+func classifyGraphQLErrors(errs []graphQLError) error {
+	e := &classifiedError{class: ClassUnknown}
+	messages := make([]string, len(errs))
+	for i, ge := range errs {
+		messages[i] = ge.String()
+		if e.class == ClassUnknown {
+			e.class = graphqlErrorClasses[ge.Type]
+		}
+	}
+	e.err = errors.Errorf("query error: %s", strings.Join(messages, "; "))
+	return e
+}
+
+// classifyResponse returns the error for a response with an unexpected
+// status code. The budget is updated if the primary rate limit is hit.
+func classifyResponse(resp *http.Response, b *budget) error {
+	body, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 4096))
+	message := strings.ToLower(string(body))
+
+	e := &classifiedError{
+		class: ClassUnknown,
+		err:   errors.Errorf("unexpected status code: %v", resp.Status),
+	}
+	if s := resp.Header.Get("Retry-After"); s != "" {
+		if seconds, err := strconv.Atoi(s); err == nil {
+			e.retryAfter = time.Duration(seconds) * time.Second
+		}
+	}
+
+	switch {
+	case resp.StatusCode == http.StatusUnauthorized:
+		e.class = ClassUnauthorized
+
+	case resp.StatusCode == http.StatusForbidden || resp.StatusCode == http.StatusTooManyRequests:
+		if resp.Header.Get("X-RateLimit-Remaining") == "0" {
+			// The primary rate limit is hit, let the budget wait for
+			// the reset.
+			e.class = ClassRateLimited
+			if reset, err := strconv.ParseInt(resp.Header.Get("X-RateLimit-Reset"), 10, 64); err == nil {
+				b.update(RateLimit{Remaining: 0, ResetAt: time.Unix(reset, 0)})
+			}
+		} else if resp.StatusCode == http.StatusTooManyRequests || e.retryAfter > 0 ||
+			strings.Contains(message, "secondary rate limit") || strings.Contains(message, "abuse") {
+			e.class = ClassRateLimited
+			e.secondary = true
+		} else {
+			e.class = ClassForbidden
+		}
+
+	case resp.StatusCode == http.StatusNotFound:
+		e.class = ClassNotFound
+
+	case resp.StatusCode >= 500:
+		e.class = ClassServerError
+	}
+
+	if e.class == ClassRateLimited {
+		kind := "primary"
+		if e.secondary {
+			kind = "secondary"
+		}
+		e.err = errors.Wrapf(e.err, "%s rate limit exceeded", kind)
+	}
+	return e
+}
+
+const (
+	// backoffBase is the delay before the first retry, which doubles on
+	// every retry.
+	backoffBase = time.Second
+
+	// backoffMax caps the delay between retries.
+	backoffMax = time.Minute
+)
+
+var (
+	jitterMu sync.Mutex
+	jitter   = rand.New(rand.NewSource(time.Now().UnixNano()))
+)
+
+// backoff returns the delay before the given retry, starting from 0. The
+// delay grows exponentially, with a random jitter so that the workers don't
+// retry all at once. The delay asked for by the server takes precedence.
+func backoff(retry int, retryAfter time.Duration) time.Duration {
+	if retryAfter > 0 {
+		return retryAfter
+	}
+
+	d := backoffBase << uint(retry)
+	if d > backoffMax || d <= 0 {
+		d = backoffMax
+	}
+
+	// Pick a random delay between d/2 and d.
+	jitterMu.Lock()
+	defer jitterMu.Unlock()
+	return d/2 + time.Duration(jitter.Int63n(int64(d/2)+1))
+}
+
+// sleep pauses for the given delay, or until ctx is done.
+func sleep(ctx context.Context, d time.Duration) error {
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
@@ -0,0 +1,58 @@
+package ghstats
+
+import (
+	"testing"
+	"time"
+)
+
+func TestBackoff(t *testing.T) {
+	tests := []struct {
+		retry      int
+		retryAfter time.Duration
+		min, max   time.Duration
+	}{
+		{0, 0, backoffBase / 2, backoffBase},
+		{1, 0, backoffBase, 2 * backoffBase},
+		{3, 0, 4 * backoffBase, 8 * backoffBase},
+		{20, 0, backoffMax / 2, backoffMax},
+		// The shift overflows.
+		{100, 0, backoffMax / 2, backoffMax},
+		// The delay asked for by the server takes precedence.
+		{0, 30 * time.Second, 30 * time.Second, 30 * time.Second},
+		{20, 2 * time.Hour, 2 * time.Hour, 2 * time.Hour},
+	}
+
+	for _, tt := range tests {
+		for i := 0; i < 100; i++ {
+			if d := backoff(tt.retry, tt.retryAfter); d < tt.min || d > tt.max {
+				t.Errorf("backoff(%d, %s) = %s, want between %s and %s", tt.retry, tt.retryAfter, d, tt.min, tt.max)
+				break
+			}
+		}
+	}
+}
+
+func TestExitCode(t *testing.T) {
+	tests := []struct {
+		classes []ErrorClass
+		want    int
+	}{
+		{nil, 0},
+		{[]ErrorClass{ClassUnknown}, 1},
+		{[]ErrorClass{ClassNotFound}, 3},
+		// A repository which is gone comes before an invalid input.
+		{[]ErrorClass{ClassUnknown, ClassNotFound}, 3},
+		{[]ErrorClass{ClassNotFound, ClassForbidden}, 5},
+		{[]ErrorClass{ClassNotFound, ClassServerError, ClassNetworkError}, 8},
+	}
+
+	for _, tt := range tests {
+		r := &Report{}
+		for _, class := range tt.classes {
+			r.countClass(class)
+		}
+		if got := r.ExitCode(); got != tt.want {
+			t.Errorf("ExitCode() with %v = %d, want %d", tt.classes, got, tt.want)
+		}
+	}
+}
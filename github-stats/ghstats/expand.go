@@ -0,0 +1,108 @@
+package ghstats
+
+import (
+	"context"
+	"encoding/json"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// Visibilities lists the accepted repository visibilities, the first one is
+// the default.
+var Visibilities = []string{"all", "public", "private"}
+
+// OwnerFilter selects the repositories an owner is expanded into. The zero
+// value selects the sources, of any visibility, which are not archived.
+type OwnerFilter struct {
+	IncludeForks    bool
+	IncludeArchived bool
+
+	// Visibility is one of Visibilities, the empty string stands for all.
+	Visibility string
+}
+
+// repositoriesQuery lists one page of the repositories owned by an
+// organization or a user.
+const repositoriesQuery = `query($login: String!, $after: String, $isFork: Boolean, $privacy: RepositoryPrivacy) {
+	repositoryOwner(login: $login) {
+		repositories(first: 100, after: $after, isFork: $isFork, privacy: $privacy, ownerAffiliations: [OWNER], orderBy: {field: NAME, direction: ASC}) {
+			pageInfo {
+				hasNextPage
+				endCursor
+			}
+			nodes {
+				name
+				isArchived
+			}
+		}
+	}
+	rateLimit {
+		limit
+		cost
+		remaining
+		resetAt
+	}
+}`
+
+// repositoriesResult receives the repositoryOwner field of
+// repositoriesQuery.
+type repositoriesResult struct {
+	Repositories struct {
+		PageInfo struct {
+			HasNextPage bool   `json:"hasNextPage"`
+			EndCursor   string `json:"endCursor"`
+		} `json:"pageInfo"`
+		Nodes []struct {
+			Name       string `json:"name"`
+			IsArchived bool   `json:"isArchived"`
+		} `json:"nodes"`
+	} `json:"repositories"`
+}
+
+// ListRepositories pages through the repositories of an owner, which is
+// either an organization or a user, and calls fn with the name of each
+// repository passing the filter.
+func (client *Client) ListRepositories(ctx context.Context, owner string, filter OwnerFilter, fn func(name string)) error {
+	variables := map[string]interface{}{
+		"login": owner,
+	}
+	if !filter.IncludeForks {
+		variables["isFork"] = false
+	}
+	if filter.Visibility != "" && filter.Visibility != "all" {
+		variables["privacy"] = strings.ToUpper(filter.Visibility)
+	}
+
+	for {
+		out, err := client.post(ctx, repositoriesQuery, variables)
+		if err != nil {
+			return err
+		}
+		if len(out.Errors) > 0 {
+			return classifyGraphQLErrors(out.Errors)
+		}
+
+		var result *repositoriesResult
+		if raw := out.Data["repositoryOwner"]; len(raw) > 0 {
+			if err := json.Unmarshal(raw, &result); err != nil {
+				return errors.Wrap(err, "json decode failed")
+			}
+		}
+		if result == nil {
+			return errors.Errorf("query error: owner not found: %s", owner)
+		}
+
+		for _, node := range result.Repositories.Nodes {
+			if node.IsArchived && !filter.IncludeArchived {
+				continue
+			}
+			fn(node.Name)
+		}
+
+		if !result.Repositories.PageInfo.HasNextPage {
+			return nil
+		}
+		variables["after"] = result.Repositories.PageInfo.EndCursor
+	}
+}
@@ -0,0 +1,334 @@
+package ghstats
+
+import (
+	"strconv"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// Field is a property of a repository which can be selected with -fields.
+// It is queried by its selection path and read back from the response by
+// the same path, so adding a field only takes a new entry in fieldRegistry.
+type Field struct {
+	// name identifies the field in -fields, and is the key of the field
+	// in the JSON formats.
+	name string
+
+	// header is the column header of the field.
+	header string
+
+	// path is the selection path of the field, relative to the repository,
+	// which is the repository itself if empty. Each element is a field,
+	// with optional alias and arguments, or an inline fragment. A path
+	// starting with branchRef is relative to the queried branch.
+	path []string
+
+	// list indicates whether the value is a list of all the matching
+	// nodes, rather than the value of the first one.
+	list bool
+
+	// leaves are the selection paths under path, if the field is derived
+	// from several properties of the nodes it leads to.
+	leaves [][]string
+
+	// sampled indicates whether the first element of path is a connection
+	// whose nodes are paged through, up to the sample size. The page size
+	// is added to its arguments.
+	sampled bool
+
+	// derive, if set, computes the value of the field from all the values
+	// the path leads to.
+	derive func(values []interface{}) interface{}
+}
+
+// Name returns the name of the field, which is its key in RepoStats.Values.
+func (f *Field) Name() string {
+	return f.name
+}
+
+// Header returns the column header of the field.
+func (f *Field) Header() string {
+	return f.header
+}
+
+// commitPath is the selection path of the latest commit of the queried
+// branch.
+var commitPath = []string{"branchRef", "target", "... on Commit", "history(first: 1)", "nodes"}
+
+func commitField(name, header string, path ...string) *Field {
+	return &Field{name: name, header: header, path: append(append([]string{}, commitPath...), path...)}
+}
+
+// fieldRegistry lists all the fields which can be selected.
+var fieldRegistry = []*Field{
+	{name: "name", header: "Name", path: []string{"name"}},
+	{name: "owner", header: "Owner", path: []string{"owner", "login"}},
+	{name: "url", header: "Clone URL", path: []string{"url"}},
+	{name: "description", header: "Description", path: []string{"description"}},
+	{name: "branch", header: "Branch", path: []string{"branchRef", "name"}},
+	{name: "stars", header: "Stars", path: []string{"stargazers", "totalCount"}},
+	{name: "forks", header: "Forks", path: []string{"forkCount"}},
+	{name: "watchers", header: "Watchers", path: []string{"watchers", "totalCount"}},
+	{name: "license", header: "License", path: []string{"licenseInfo", "spdxId"}},
+	{name: "primaryLanguage", header: "Primary Language", path: []string{"primaryLanguage", "name"}},
+	{name: "topics", header: "Topics", path: []string{"repositoryTopics(first: 20)", "nodes", "topic", "name"}, list: true},
+	{name: "isArchived", header: "Archived", path: []string{"isArchived"}},
+	{name: "isFork", header: "Fork", path: []string{"isFork"}},
+	{name: "diskUsage", header: "Disk Usage (KB)", path: []string{"diskUsage"}},
+	{name: "openIssues", header: "Open Issues", path: []string{"openIssues: issues(states: OPEN)", "totalCount"}},
+	{name: "openPRs", header: "Open Pull Requests", path: []string{"openPRs: pullRequests(states: OPEN)", "totalCount"}},
+	{name: "createdAt", header: "Date of Creation", path: []string{"createdAt"}},
+	{name: "pushedAt", header: "Date of Latest Push", path: []string{"pushedAt"}},
+	{name: "prs.medianResponseHours", header: "Median Hours to First Response", path: []string{closedPRs, "nodes"}, leaves: prLeaves, sampled: true, derive: medianResponseHours},
+	{name: "prs.medianMergeHours", header: "Median Hours to Merge", path: []string{closedPRs, "nodes"}, leaves: prLeaves, sampled: true, derive: medianMergeHours},
+	{name: "prs.oldestOpenDays", header: "Age of Oldest Open PR (days)", path: []string{oldestOpenPR, "nodes", "createdAt"}, derive: ageDays},
+	releaseField("release.tag", "Latest Release", []string{"tagName"}, first),
+	releaseField("release.publishedAt", "Date of Latest Release", []string{"publishedAt"}, first),
+	releaseField("release.isPrerelease", "Prerelease", []string{"isPrerelease"}, first),
+	releaseField("release.downloads", "Downloads of Latest Release", []string{"releaseAssets(first: 100)", "nodes", "downloadCount"}, sum),
+	{name: "tag.latest", header: "Latest Semver Tag", path: []string{latestTags, "nodes"}, leaves: [][]string{{"name"}}, derive: latestTagName},
+	{name: "tag.commitsSince", header: "Commits Since Tag", leaves: commitsSinceLeaves, derive: commitsSinceTag},
+	commitField("lastCommit.date", "Date of Latest Commit", "author", "date"),
+	commitField("lastCommit.author", "Name of Latest Author", "author", "name"),
+	commitField("lastCommit.message", "Message of Latest Commit", "messageHeadline"),
+}
+
+// defaultFieldNames are the fields which are output if -fields is not set.
+var defaultFieldNames = []string{"name", "url", "branch", "lastCommit.date", "lastCommit.author"}
+
+// coreFieldNames are the fields which are always queried, whether they are
+// output or not, because RepoStats is built from them.
+var coreFieldNames = []string{"name", "url", "branch", "lastCommit.date", "lastCommit.author"}
+
+// DefaultFields returns the fields which are output if -fields is not set.
+func DefaultFields() []*Field {
+	fields := make([]*Field, len(defaultFieldNames))
+	for i, name := range defaultFieldNames {
+		fields[i] = LookupField(name)
+	}
+	return fields
+}
+
+// LookupField returns the registered field with the given name, or nil.
+func LookupField(name string) *Field {
+	for _, f := range fieldRegistry {
+		if f.name == name {
+			return f
+		}
+	}
+	return nil
+}
+
+// ParseFields parses a comma separated list of field names.
+func ParseFields(s string) ([]*Field, error) {
+	var fields []*Field
+	for _, name := range strings.Split(s, ",") {
+		name = strings.TrimSpace(name)
+		if name == "" {
+			continue
+		}
+		f := LookupField(name)
+		if f == nil {
+			return nil, errors.Errorf("unknown field %q, should be one of %s", name, strings.Join(FieldNames(), ","))
+		}
+		fields = append(fields, f)
+	}
+	if len(fields) == 0 {
+		return nil, errors.New("no fields selected")
+	}
+	return fields, nil
+}
+
+// queriedFields returns the selected fields along with the core ones,
+// without duplicates.
+func queriedFields(selected []*Field) []*Field {
+	fields := append([]*Field{}, selected...)
+	for _, name := range coreFieldNames {
+		f := LookupField(name)
+		found := false
+		for _, s := range fields {
+			if s == f {
+				found = true
+				break
+			}
+		}
+		if !found {
+			fields = append(fields, f)
+		}
+	}
+	return fields
+}
+
+// selection is a node of a GraphQL selection set.
+type selection struct {
+	key      string
+	children []*selection
+}
+
+// add merges a selection path into the selection set.
+func (s *selection) add(path []string) {
+	if len(path) == 0 {
+		return
+	}
+	for _, child := range s.children {
+		if child.key == path[0] {
+			child.add(path[1:])
+			return
+		}
+	}
+	child := &selection{key: path[0]}
+	s.children = append(s.children, child)
+	child.add(path[1:])
+}
+
+// render writes the selection set, one field per line.
+func (s *selection) render(b *strings.Builder, indent int) {
+	for _, child := range s.children {
+		b.WriteString(strings.Repeat("\t", indent))
+		b.WriteString(child.key)
+		if len(child.children) > 0 {
+			b.WriteString(" {\n")
+			child.render(b, indent+1)
+			b.WriteString(strings.Repeat("\t", indent))
+			b.WriteString("}")
+		}
+		b.WriteString("\n")
+	}
+}
+
+// selectionPaths returns the selection paths of the field, with pageSize
+// nodes per page if it is sampled. after is the variable of the cursor of
+// the page, if any.
+func (f *Field) selectionPaths(pageSize int, after string) [][]string {
+	path := f.path
+	var paths [][]string
+	if f.sampled {
+		conn := pageArguments(path[0], pageSize, after)
+		path = append([]string{conn}, path[1:]...)
+		paths = append(paths, []string{conn, "pageInfo", "hasNextPage"}, []string{conn, "pageInfo", "endCursor"})
+	}
+	if len(f.leaves) == 0 {
+		return append(paths, path)
+	}
+	for _, leaf := range f.leaves {
+		paths = append(paths, append(append([]string{}, path...), leaf...))
+	}
+	return paths
+}
+
+// selectionSets builds the selection sets of the repoFields and refFields
+// fragments for the given fields. The sampled connections are selected
+// with pageSize nodes.
+func selectionSets(fields []*Field, pageSize int) (repoFields, refFields string) {
+	repo := &selection{}
+	ref := &selection{}
+	for _, f := range fields {
+		for _, path := range f.selectionPaths(pageSize, "") {
+			if path[0] == "branchRef" {
+				ref.add(path[1:])
+			} else {
+				repo.add(path)
+			}
+		}
+	}
+
+	var b strings.Builder
+	repo.render(&b, 1)
+	repoFields = b.String()
+
+	b.Reset()
+	ref.render(&b, 1)
+	refFields = b.String()
+	return
+}
+
+// responseKey returns the key under which a selection appears in the
+// response, or an empty string for inline fragments.
+func responseKey(selection string) string {
+	if strings.HasPrefix(selection, "...") {
+		return ""
+	}
+	// Strip the arguments first, as they may contain colons too.
+	if i := strings.Index(selection, "("); i >= 0 {
+		selection = selection[:i]
+	}
+	if i := strings.Index(selection, ":"); i >= 0 {
+		selection = selection[:i]
+	}
+	return strings.TrimSpace(selection)
+}
+
+// extract reads the value of the field from a decoded repository.
+func (f *Field) extract(repo map[string]interface{}) interface{} {
+	values := walk(repo, f.path)
+	if f.derive != nil {
+		return f.derive(values)
+	}
+	if f.list {
+		list := []string{}
+		for _, v := range values {
+			list = append(list, FormatValue(v))
+		}
+		return list
+	}
+	if len(values) == 0 {
+		return nil
+	}
+	return values[0]
+}
+
+// walk follows a selection path from a decoded JSON value, and returns all
+// the values at the end of it. Lists are walked element by element.
+func walk(v interface{}, path []string) []interface{} {
+	if v == nil {
+		return nil
+	}
+	if list, ok := v.([]interface{}); ok {
+		var values []interface{}
+		for _, elem := range list {
+			values = append(values, walk(elem, path)...)
+		}
+		return values
+	}
+	if len(path) == 0 {
+		return []interface{}{v}
+	}
+
+	key := responseKey(path[0])
+	if key == "" {
+		return walk(v, path[1:])
+	}
+	obj, ok := v.(map[string]interface{})
+	if !ok {
+		return nil
+	}
+	return walk(obj[key], path[1:])
+}
+
+// FormatValue converts a decoded JSON value to a string for the text based
+// formats.
+func FormatValue(v interface{}) string {
+	switch v := v.(type) {
+	case nil:
+		return ""
+	case string:
+		return v
+	case bool:
+		return strconv.FormatBool(v)
+	case float64:
+		return strconv.FormatFloat(v, 'f', -1, 64)
+	case []string:
+		return strings.Join(v, ";")
+	}
+	return ""
+}
+
+// FieldNames returns the names of all the registered fields.
+func FieldNames() []string {
+	var names []string
+	for _, f := range fieldRegistry {
+		names = append(names, f.name)
+	}
+	return names
+}
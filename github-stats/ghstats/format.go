@@ -0,0 +1,439 @@
+package ghstats
+
+import (
+	"bytes"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"strings"
+	"text/tabwriter"
+)
+
+// Formats lists the supported output formats, the first one is the default.
+var Formats = []string{"csv", "json", "ndjson", "markdown", "table"}
+
+// formatter writes the results of a run, followed by the report.
+type formatter interface {
+	// record writes one result. Formats which can not be streamed may
+	// buffer it until finish is called.
+	record(stats *RepoStats) error
+
+	// finish writes the errors and the summary if they are enabled, and
+	// flushes the output.
+	finish(r *Report) error
+}
+
+// newFormatter returns the formatter for the given format, which writes the
+// given fields of each result.
+func newFormatter(format string, w io.Writer, fields []*Field) formatter {
+	switch format {
+	case "json":
+		return &jsonFormatter{w: w, fields: fields}
+	case "ndjson":
+		return &ndjsonFormatter{enc: json.NewEncoder(w), fields: fields}
+	case "markdown":
+		return &markdownFormatter{w: w, fields: fields}
+	case "table":
+		return &tableFormatter{w: w, tw: tabwriter.NewWriter(w, 0, 8, 2, ' ', 0), fields: fields}
+	default:
+		return &csvFormatter{w: w, writer: csv.NewWriter(w), fields: fields}
+	}
+}
+
+// JSONRecord is the JSON form of a result. It holds the given fields in
+// order, preceded by the type if it is set.
+type JSONRecord struct {
+	Type   string
+	Fields []*Field
+	Stats  *RepoStats
+}
+
+func (r JSONRecord) MarshalJSON() ([]byte, error) {
+	var b bytes.Buffer
+	b.WriteByte('{')
+	if r.Type != "" {
+		fmt.Fprintf(&b, `"type":%q,`, r.Type)
+	}
+	for i, f := range r.Fields {
+		if i > 0 {
+			b.WriteByte(',')
+		}
+		key, err := json.Marshal(f.name)
+		if err != nil {
+			return nil, err
+		}
+		value, err := json.Marshal(r.Stats.Values[f.name])
+		if err != nil {
+			return nil, err
+		}
+		b.Write(key)
+		b.WriteByte(':')
+		b.Write(value)
+	}
+	b.WriteByte('}')
+	return b.Bytes(), nil
+}
+
+// Report collects everything but the results of a run.
+type Report struct {
+	InputErrors []InputError
+	QueryErrors []QueryError
+
+	// Warnings holds the errors of the fields which failed to resolve in
+	// the partial results.
+	Warnings []QueryError
+
+	// SkipErr is set if queries were skipped because of an exhausted rate
+	// limit budget or a cancellation.
+	SkipErr error
+
+	Summary Summary
+
+	// showErrors and showSummary tell whether the errors and the summary
+	// are written after the results.
+	showErrors  bool
+	showSummary bool
+}
+
+// Summary counts the inputs of a run.
+type Summary struct {
+	Total     int `json:"total"`
+	Succeeded int `json:"succeeded"`
+	Failed    int `json:"failed"`
+	Skipped   int `json:"skipped,omitempty"`
+
+	// Cached counts the successes read from the cache.
+	Cached int `json:"cached,omitempty"`
+
+	// Partial counts the successes missing some fields, which failed to
+	// resolve.
+	Partial int `json:"partial,omitempty"`
+
+	// Classes counts the failures by error class.
+	Classes map[string]int `json:"classes,omitempty"`
+
+	// Statuses counts the repositories by status in a diff run.
+	Statuses map[string]int `json:"statuses,omitempty"`
+
+	// Freshness counts the repositories by freshness with -stale-after.
+	Freshness map[string]int `json:"freshness,omitempty"`
+
+	// Tokens reports the use of the tokens of the pool, if any.
+	Tokens []TokenUsage `json:"tokens,omitempty"`
+}
+
+// countClass counts a failure of the given class.
+func (r *Report) countClass(class ErrorClass) {
+	if r.Summary.Classes == nil {
+		r.Summary.Classes = make(map[string]int)
+	}
+	r.Summary.Classes[class.String()]++
+}
+
+// countStatus counts a repository of the given status in a diff run.
+func (r *Report) countStatus(status string) {
+	if r.Summary.Statuses == nil {
+		r.Summary.Statuses = make(map[string]int)
+	}
+	r.Summary.Statuses[status]++
+}
+
+// countFreshness counts a repository of the given freshness.
+func (r *Report) countFreshness(freshness string) {
+	if r.Summary.Freshness == nil {
+		r.Summary.Freshness = make(map[string]int)
+	}
+	r.Summary.Freshness[freshness]++
+}
+
+// ExitCode returns the exit code of the process: 0 if nothing failed,
+// otherwise the exit code of the error class with the highest priority.
+// Skipped queries count as failures as well. Otherwise, a run which found
+// stale or archived repositories exits with exitStale, and a diff run which
+// detected changes exits with exitChanges.
+func (r *Report) ExitCode() int {
+	for _, class := range exitPriority {
+		if r.Summary.Classes[class.String()] > 0 {
+			return exitCodes[class]
+		}
+	}
+	if r.SkipErr != nil {
+		return exitCodes[Classify(r.SkipErr)]
+	}
+	if r.Summary.Freshness["stale"] > 0 || r.Summary.Freshness["archived"] > 0 {
+		return exitStale
+	}
+	for status, n := range r.Summary.Statuses {
+		if status != "unchanged" && n > 0 {
+			return exitChanges
+		}
+	}
+	return 0
+}
+
+// ErrorRecord is the machine-readable form of an input or query error.
+type ErrorRecord struct {
+	Kind  string `json:"kind"`
+	Class string `json:"class"`
+	Input string `json:"input"`
+	Error string `json:"error"`
+}
+
+// ErrorRecords returns the errors and the warnings of the run.
+func (r *Report) ErrorRecords() []ErrorRecord {
+	records := []ErrorRecord{}
+	for _, e := range r.InputErrors {
+		records = append(records, ErrorRecord{"input", Classify(e.Err).String(), e.Input, e.Err.Error()})
+	}
+	for _, e := range r.QueryErrors {
+		records = append(records, ErrorRecord{"query", Classify(e.Err).String(), e.Input, e.Err.Error()})
+	}
+	for _, e := range r.Warnings {
+		records = append(records, ErrorRecord{"warning", Classify(e.Err).String(), e.Input, e.Err.Error()})
+	}
+	return records
+}
+
+// errorRecords returns the errors to write, or nil if they are disabled.
+func (r *Report) errorRecords() []ErrorRecord {
+	if !r.showErrors {
+		return nil
+	}
+	return r.ErrorRecords()
+}
+
+// writeText writes the errors and the summary in a human readable form.
+func (r *Report) writeText(w io.Writer) {
+	if r.showErrors {
+		if len(r.InputErrors) > 0 {
+			fmt.Fprintf(w, "\n\nInput Errors:\n")
+			for _, ie := range r.InputErrors {
+				fmt.Fprintf(w, "  <%s> %s\n", ie.Input, ie.Err)
+			}
+		}
+
+		if len(r.QueryErrors) > 0 {
+			fmt.Fprintf(w, "\n\nQuery Errors:\n")
+			for _, qe := range r.QueryErrors {
+				fmt.Fprintf(w, "  <%s> %s\n", qe.Input, qe.Err)
+			}
+		}
+
+		if len(r.Warnings) > 0 {
+			fmt.Fprintf(w, "\n\nQuery Warnings (partial results):\n")
+			for _, qw := range r.Warnings {
+				fmt.Fprintf(w, "  <%s> %s\n", qw.Input, qw.Err)
+			}
+		}
+	}
+
+	if r.showSummary {
+		fmt.Fprintf(w, "\n\nSummaries:\n")
+		fmt.Fprintf(w, "  Total Unique Inputs (not including empty lines): %d\n", r.Summary.Total)
+		fmt.Fprintf(w, "  Succeeded: %d\n", r.Summary.Succeeded)
+		if r.Summary.Cached > 0 {
+			fmt.Fprintf(w, "    from cache: %d\n", r.Summary.Cached)
+		}
+		if r.Summary.Partial > 0 {
+			fmt.Fprintf(w, "    partial: %d\n", r.Summary.Partial)
+		}
+		fmt.Fprintf(w, "  Failed: %d\n", r.Summary.Failed)
+		for _, class := range exitPriority {
+			if n := r.Summary.Classes[class.String()]; n > 0 {
+				fmt.Fprintf(w, "    %s: %d\n", strings.Replace(class.String(), "_", " ", -1), n)
+			}
+		}
+		if r.Summary.Skipped > 0 {
+			fmt.Fprintf(w, "  Skipped: %d (%s)\n", r.Summary.Skipped, r.SkipErr)
+		}
+		if r.Summary.Freshness != nil {
+			fmt.Fprintf(w, "  Freshness:\n")
+			for _, freshness := range freshnesses {
+				fmt.Fprintf(w, "    %s: %d\n", freshness, r.Summary.Freshness[freshness])
+			}
+		}
+		if r.Summary.Statuses != nil {
+			fmt.Fprintf(w, "  Changes:\n")
+			for _, status := range statuses {
+				fmt.Fprintf(w, "    %s: %d\n", status, r.Summary.Statuses[status])
+			}
+		}
+		if r.Summary.Tokens != nil {
+			fmt.Fprintf(w, "  Tokens:\n")
+			for _, t := range r.Summary.Tokens {
+				fmt.Fprintf(w, "    %s: %d requests, %d points", t.Token, t.Requests, t.Cost)
+				if t.Revoked {
+					fmt.Fprintf(w, ", revoked")
+				} else if t.Remaining != nil {
+					fmt.Fprintf(w, ", %d remaining", *t.Remaining)
+				}
+				fmt.Fprintln(w)
+			}
+		}
+	}
+}
+
+// csvFormatter writes the results as csv records, with a header record
+// preceding the first one.
+type csvFormatter struct {
+	w      io.Writer
+	writer *csv.Writer
+	fields []*Field
+	n      int
+}
+
+func (f *csvFormatter) record(stats *RepoStats) error {
+	if f.n == 0 {
+		f.writer.Write(CsvHeader(f.fields))
+	}
+	f.n++
+	return f.writer.Write(stats.CsvRecord(f.fields))
+}
+
+func (f *csvFormatter) finish(r *Report) error {
+	f.writer.Flush()
+	if err := f.writer.Error(); err != nil {
+		return err
+	}
+	r.writeText(f.w)
+	return nil
+}
+
+// tableFormatter writes the results as an aligned table for terminals.
+type tableFormatter struct {
+	w      io.Writer
+	tw     *tabwriter.Writer
+	fields []*Field
+	n      int
+}
+
+// tableEscaper replaces the characters which would break a table row.
+var tableEscaper = strings.NewReplacer("\t", " ", "\n", " ")
+
+func (f *tableFormatter) row(cells []string) error {
+	escaped := make([]string, len(cells))
+	for i, c := range cells {
+		escaped[i] = tableEscaper.Replace(c)
+	}
+	_, err := fmt.Fprintln(f.tw, strings.Join(escaped, "\t"))
+	return err
+}
+
+func (f *tableFormatter) record(stats *RepoStats) error {
+	if f.n == 0 {
+		f.row(CsvHeader(f.fields))
+	}
+	f.n++
+	return f.row(stats.CsvRecord(f.fields))
+}
+
+func (f *tableFormatter) finish(r *Report) error {
+	if err := f.tw.Flush(); err != nil {
+		return err
+	}
+	r.writeText(f.w)
+	return nil
+}
+
+// markdownFormatter writes the results as a Markdown table.
+type markdownFormatter struct {
+	w      io.Writer
+	fields []*Field
+	n      int
+}
+
+// markdownEscaper escapes the characters which would break a table cell.
+var markdownEscaper = strings.NewReplacer("|", "\\|", "\n", " ")
+
+func (f *markdownFormatter) row(cells []string) error {
+	escaped := make([]string, len(cells))
+	for i, c := range cells {
+		escaped[i] = markdownEscaper.Replace(c)
+	}
+	_, err := fmt.Fprintf(f.w, "| %s |\n", strings.Join(escaped, " | "))
+	return err
+}
+
+func (f *markdownFormatter) record(stats *RepoStats) error {
+	if f.n == 0 {
+		header := CsvHeader(f.fields)
+		f.row(header)
+		rule := make([]string, len(header))
+		for i := range rule {
+			rule[i] = "---"
+		}
+		f.row(rule)
+	}
+	f.n++
+	return f.row(stats.CsvRecord(f.fields))
+}
+
+func (f *markdownFormatter) finish(r *Report) error {
+	r.writeText(f.w)
+	return nil
+}
+
+// jsonFormatter writes a single JSON document holding the results, and the
+// errors and the summary if they are enabled.
+type jsonFormatter struct {
+	w       io.Writer
+	fields  []*Field
+	results []JSONRecord
+}
+
+func (f *jsonFormatter) record(stats *RepoStats) error {
+	f.results = append(f.results, JSONRecord{Fields: f.fields, Stats: stats})
+	return nil
+}
+
+func (f *jsonFormatter) finish(r *Report) error {
+	doc := struct {
+		Results []JSONRecord  `json:"results"`
+		Errors  []ErrorRecord `json:"errors,omitempty"`
+		Summary *Summary      `json:"summary,omitempty"`
+	}{
+		Results: f.results,
+		Errors:  r.errorRecords(),
+	}
+	if doc.Results == nil {
+		doc.Results = []JSONRecord{}
+	}
+	if r.showSummary {
+		doc.Summary = &r.Summary
+	}
+
+	enc := json.NewEncoder(f.w)
+	enc.SetIndent("", "  ")
+	return enc.Encode(doc)
+}
+
+// ndjsonFormatter writes one JSON object per line. Every object has a type
+// field, which is one of result, error and summary.
+type ndjsonFormatter struct {
+	enc    *json.Encoder
+	fields []*Field
+}
+
+func (f *ndjsonFormatter) record(stats *RepoStats) error {
+	return f.enc.Encode(JSONRecord{"result", f.fields, stats})
+}
+
+func (f *ndjsonFormatter) finish(r *Report) error {
+	for _, e := range r.errorRecords() {
+		err := f.enc.Encode(struct {
+			Type string `json:"type"`
+			ErrorRecord
+		}{"error", e})
+		if err != nil {
+			return err
+		}
+	}
+	if r.showSummary {
+		return f.enc.Encode(struct {
+			Type string `json:"type"`
+			Summary
+		}{"summary", r.Summary})
+	}
+	return nil
+}
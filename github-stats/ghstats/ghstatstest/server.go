@@ -0,0 +1,561 @@
+// Package ghstatstest provides a fake Github GraphQL API, to run the
+// ghstats clients against in the tests of the programs using them.
+//
+// The fake understands the queries sent by ghstats.Client only: the
+// batches of repositories, the pages of their closed pull requests, the
+// listing of the repositories of an owner and the search. The
+// repositories, with their releases and tags, are served from memory:
+//
+//	srv := ghstatstest.NewServer(ghstatstest.Repo{
+//		Owner:    "octocat",
+//		Name:     "hello-world",
+//		Stars:    42,
+//		PushedAt: time.Date(2018, 5, 1, 0, 0, 0, 0, time.UTC),
+//	})
+//	defer srv.Close()
+//	client := ghstats.NewClient(nil, srv.Endpoint(), ghstats.Options{})
+package ghstatstest
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Repo is a repository served by the fake.
+type Repo struct {
+	Owner       string
+	Name        string
+	Description string
+
+	// DefaultBranch is "master" if empty. Branches holds the latest commit
+	// of every branch. The default branch always exists, its latest commit
+	// is dated PushedAt, with a history of Commits commits, unless it is in
+	// Branches. A commit with a zero Date stands for an empty history.
+	DefaultBranch string
+	Branches      map[string]Commit
+	Commits       int
+
+	Stars      int
+	Forks      int
+	Watchers   int
+	OpenIssues int
+	OpenPRs    int
+	DiskUsage  int
+
+	License  string
+	Language string
+	Topics   []string
+
+	Archived bool
+	Fork     bool
+	Private  bool
+
+	CreatedAt time.Time
+	PushedAt  time.Time
+
+	// PullRequests are the pull requests of the repository, from which
+	// the health fields are computed. OpenPRs is not derived from them.
+	PullRequests []PullRequest
+
+	// Releases are the releases of the repository, in the order they were
+	// created, and Tags its tags.
+	Releases []Release
+	Tags     []Tag
+}
+
+// Release is a release of a repository.
+type Release struct {
+	Tag         string
+	PublishedAt time.Time
+	Draft       bool
+	Prerelease  bool
+
+	// Downloads holds the download count of every asset.
+	Downloads []int
+}
+
+// Tag is a tag of a repository. Commits is the number of commits of its
+// history, and Date the date of its commit.
+type Tag struct {
+	Name      string
+	Date      time.Time
+	Commits   int
+	Annotated bool
+}
+
+// PullRequest is a pull request of a repository. It is open unless it is
+// closed or merged.
+type PullRequest struct {
+	Author    string
+	CreatedAt time.Time
+	ClosedAt  time.Time
+	MergedAt  time.Time
+
+	// Comments and Reviews are in the order they were posted.
+	Comments []Comment
+	Reviews  []Comment
+}
+
+func (pr PullRequest) open() bool {
+	return pr.ClosedAt.IsZero() && pr.MergedAt.IsZero()
+}
+
+// closed returns when the pull request was closed or merged.
+func (pr PullRequest) closed() time.Time {
+	if pr.ClosedAt.IsZero() {
+		return pr.MergedAt
+	}
+	return pr.ClosedAt
+}
+
+// Comment is a comment or a review of a pull request.
+type Comment struct {
+	Author    string
+	CreatedAt time.Time
+}
+
+// Commit is the latest commit of a branch. Commits is the number of
+// commits of the history of the branch.
+type Commit struct {
+	Message string
+	Author  string
+	Date    time.Time
+	Commits int
+}
+
+// Server is a fake Github GraphQL API. Its rate limit budget decreases by
+// one point on every request, and never resets.
+type Server struct {
+	*httptest.Server
+
+	mu        sync.Mutex
+	repos     map[string]Repo
+	remaining int
+}
+
+// NewServer starts a fake serving the given repositories. It should be
+// closed once done.
+func NewServer(repos ...Repo) *Server {
+	s := &Server{repos: make(map[string]Repo), remaining: 5000}
+	for _, r := range repos {
+		s.Add(r)
+	}
+	s.Server = httptest.NewServer(http.HandlerFunc(s.handle))
+	return s
+}
+
+// Endpoint returns the GraphQL endpoint of the fake.
+func (s *Server) Endpoint() string {
+	return s.URL + "/graphql"
+}
+
+// Add adds a repository, or replaces the one with the same name.
+func (s *Server) Add(r Repo) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.repos[repoKey(r.Owner, r.Name)] = r
+}
+
+func repoKey(owner, name string) string {
+	return strings.ToLower(owner + "/" + name)
+}
+
+// gqlError is an error of a GraphQL response.
+type gqlError struct {
+	Type    string        `json:"type,omitempty"`
+	Path    []interface{} `json:"path,omitempty"`
+	Message string        `json:"message"`
+}
+
+// pageSizePattern matches the page size of the closed pull requests.
+var pageSizePattern = regexp.MustCompile(`closedPRs: pullRequests\(first: (\d+)`)
+
+// repositoryPattern matches the aliased repository fields of a batch query,
+// see the queryTemplate of ghstats.
+var repositoryPattern = regexp.MustCompile(`(r\d+): repository\(owner: ("(?:[^"\\]|\\.)*"), name: ("(?:[^"\\]|\\.)*")\) \{\s*\.\.\.repoFields\s*branchRef: (?:ref\(qualifiedName: ("(?:[^"\\]|\\.)*")\)|defaultBranchRef)`)
+
+func (s *Server) handle(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost || r.URL.Path != "/graphql" {
+		http.Error(w, `{"message":"Not Found"}`, http.StatusNotFound)
+		return
+	}
+	var body struct {
+		Query     string                 `json:"query"`
+		Variables map[string]interface{} `json:"variables"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+		http.Error(w, `{"message":"Problems parsing JSON"}`, http.StatusBadRequest)
+		return
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	data := make(map[string]interface{})
+	var errs []gqlError
+	switch {
+	case body.Variables["login"] != nil:
+		data["repositoryOwner"], errs = s.owner(body.Variables)
+	case body.Variables["query"] != nil:
+		data["search"] = s.search(body.Variables)
+	case body.Variables["after"] != nil && body.Variables["owner"] != nil:
+		data["repository"], errs = s.pullRequests(body.Query, body.Variables)
+	default:
+		for _, m := range repositoryPattern.FindAllStringSubmatch(body.Query, -1) {
+			alias := m[1]
+			owner, _ := strconv.Unquote(m[2])
+			name, _ := strconv.Unquote(m[3])
+			repo, ok := s.repos[repoKey(owner, name)]
+			if !ok {
+				data[alias] = nil
+				errs = append(errs, gqlError{
+					Type:    "NOT_FOUND",
+					Path:    []interface{}{alias},
+					Message: "Could not resolve to a Repository with the name '" + owner + "/" + name + "'.",
+				})
+				continue
+			}
+			var branch string
+			if m[4] != "" {
+				branch, _ = strconv.Unquote(m[4])
+				branch = strings.TrimPrefix(branch, "refs/heads/")
+			}
+			data[alias] = repository(repo, branch, pageSize(body.Query))
+		}
+	}
+
+	s.remaining--
+	data["rateLimit"] = map[string]interface{}{
+		"limit":     5000,
+		"cost":      1,
+		"remaining": s.remaining,
+		"resetAt":   time.Now().Add(time.Hour).UTC().Format(time.RFC3339),
+	}
+
+	out := map[string]interface{}{"data": data}
+	if len(errs) > 0 {
+		out["errors"] = errs
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(out)
+}
+
+// repository returns the response of a repository, on the given branch or
+// on its default branch if empty. The branch is null if it does not exist.
+// The first page of the closed pull requests holds pageSize of them.
+func repository(r Repo, branch string, pageSize int) map[string]interface{} {
+	defaultBranch := r.DefaultBranch
+	if defaultBranch == "" {
+		defaultBranch = "master"
+	}
+	if branch == "" {
+		branch = defaultBranch
+	}
+
+	defaultCommit, ok := r.Branches[defaultBranch]
+	if !ok {
+		defaultCommit = Commit{Date: r.PushedAt, Commits: r.Commits}
+	}
+	defaultBranchRef := map[string]interface{}{
+		"target": map[string]interface{}{"history": count(defaultCommit.Commits)},
+	}
+
+	var branchRef interface{}
+	c, ok := r.Branches[branch]
+	if !ok && branch == defaultBranch {
+		c, ok = defaultCommit, true
+	}
+	if ok {
+		nodes := []interface{}{}
+		if !c.Date.IsZero() {
+			nodes = append(nodes, map[string]interface{}{
+				"messageHeadline": c.Message,
+				"author": map[string]interface{}{
+					"name": c.Author,
+					"date": formatTime(c.Date),
+				},
+			})
+		}
+		branchRef = map[string]interface{}{
+			"name":   branch,
+			"target": map[string]interface{}{"history": map[string]interface{}{"totalCount": c.Commits, "nodes": nodes}},
+		}
+	}
+
+	topics := make([]interface{}, len(r.Topics))
+	for i, t := range r.Topics {
+		topics[i] = map[string]interface{}{"topic": map[string]interface{}{"name": t}}
+	}
+
+	return map[string]interface{}{
+		"name":             r.Name,
+		"owner":            map[string]interface{}{"login": r.Owner},
+		"url":              "https://github.com/" + r.Owner + "/" + r.Name,
+		"description":      nullable(r.Description),
+		"branchRef":        branchRef,
+		"defaultBranchRef": defaultBranchRef,
+		"stargazers":       count(r.Stars),
+		"forkCount":        r.Forks,
+		"watchers":         count(r.Watchers),
+		"licenseInfo":      named("spdxId", r.License),
+		"primaryLanguage":  named("name", r.Language),
+		"repositoryTopics": map[string]interface{}{"nodes": topics},
+		"isArchived":       r.Archived,
+		"isFork":           r.Fork,
+		"diskUsage":        r.DiskUsage,
+		"openIssues":       count(r.OpenIssues),
+		"openPRs":          count(r.OpenPRs),
+		"createdAt":        formatTime(r.CreatedAt),
+		"pushedAt":         formatTime(r.PushedAt),
+		"closedPRs":        closedPRs(r, pageSize, nil),
+		"oldestOpenPR":     oldestOpenPR(r),
+		"latestReleases":   latestReleases(r),
+		"latestTags":       latestTags(r),
+	}
+}
+
+// latestReleases returns the latest 10 releases, the latest created first.
+func latestReleases(r Repo) map[string]interface{} {
+	nodes := []interface{}{}
+	for i := len(r.Releases) - 1; i >= 0 && len(nodes) < 10; i-- {
+		release := r.Releases[i]
+		assets := make([]interface{}, len(release.Downloads))
+		for j, n := range release.Downloads {
+			assets[j] = map[string]interface{}{"downloadCount": n}
+		}
+		nodes = append(nodes, map[string]interface{}{
+			"tagName":       release.Tag,
+			"publishedAt":   formatTime(release.PublishedAt),
+			"isDraft":       release.Draft,
+			"isPrerelease":  release.Prerelease,
+			"releaseAssets": map[string]interface{}{"nodes": assets},
+		})
+	}
+	return map[string]interface{}{"nodes": nodes}
+}
+
+// latestTags returns the tags of the latest 20 commits, the latest first.
+func latestTags(r Repo) map[string]interface{} {
+	tags := append([]Tag{}, r.Tags...)
+	sort.SliceStable(tags, func(i, j int) bool { return tags[i].Date.After(tags[j].Date) })
+	if len(tags) > 20 {
+		tags = tags[:20]
+	}
+
+	nodes := make([]interface{}, len(tags))
+	for i, t := range tags {
+		target := map[string]interface{}{"history": count(t.Commits)}
+		if t.Annotated {
+			target = map[string]interface{}{"target": target}
+		}
+		nodes[i] = map[string]interface{}{"name": t.Name, "target": target}
+	}
+	return map[string]interface{}{"nodes": nodes}
+}
+
+// pageSize returns the page size of the closed pull requests in a query.
+func pageSize(query string) int {
+	if m := pageSizePattern.FindStringSubmatch(query); m != nil {
+		n, _ := strconv.Atoi(m[1])
+		return n
+	}
+	return 0
+}
+
+// closedPRs returns a page of the closed pull requests, the latest closed
+// first.
+func closedPRs(r Repo, first int, after interface{}) map[string]interface{} {
+	var prs []PullRequest
+	for _, pr := range r.PullRequests {
+		if !pr.open() {
+			prs = append(prs, pr)
+		}
+	}
+	sort.SliceStable(prs, func(i, j int) bool { return prs[i].closed().After(prs[j].closed()) })
+
+	start, end, pageInfo := page(len(prs), first, after)
+	nodes := make([]interface{}, 0, end-start)
+	for _, pr := range prs[start:end] {
+		nodes = append(nodes, map[string]interface{}{
+			"createdAt": formatTime(pr.CreatedAt),
+			"mergedAt":  formatTime(pr.MergedAt),
+			"author":    named("login", pr.Author),
+			"comments":  map[string]interface{}{"nodes": comments(pr.Comments)},
+			"reviews":   map[string]interface{}{"nodes": comments(pr.Reviews)},
+		})
+	}
+	return map[string]interface{}{"pageInfo": pageInfo, "nodes": nodes}
+}
+
+// comments returns the first 10 comments, as many as are queried.
+func comments(cs []Comment) []interface{} {
+	nodes := []interface{}{}
+	for i, c := range cs {
+		if i == 10 {
+			break
+		}
+		nodes = append(nodes, map[string]interface{}{
+			"author":    named("login", c.Author),
+			"createdAt": formatTime(c.CreatedAt),
+		})
+	}
+	return nodes
+}
+
+// oldestOpenPR returns the oldest open pull request, if any.
+func oldestOpenPR(r Repo) map[string]interface{} {
+	nodes := []interface{}{}
+	var oldest *PullRequest
+	for i, pr := range r.PullRequests {
+		if pr.open() && (oldest == nil || pr.CreatedAt.Before(oldest.CreatedAt)) {
+			oldest = &r.PullRequests[i]
+		}
+	}
+	if oldest != nil {
+		nodes = append(nodes, map[string]interface{}{"createdAt": formatTime(oldest.CreatedAt)})
+	}
+	return map[string]interface{}{"nodes": nodes}
+}
+
+// pullRequests returns the next page of the closed pull requests of the
+// repository of the owner and name variables.
+func (s *Server) pullRequests(query string, variables map[string]interface{}) (interface{}, []gqlError) {
+	owner, _ := variables["owner"].(string)
+	name, _ := variables["name"].(string)
+	repo, ok := s.repos[repoKey(owner, name)]
+	if !ok {
+		return nil, []gqlError{{
+			Type:    "NOT_FOUND",
+			Path:    []interface{}{"repository"},
+			Message: "Could not resolve to a Repository with the name '" + owner + "/" + name + "'.",
+		}}
+	}
+	return map[string]interface{}{
+		"closedPRs": closedPRs(repo, pageSize(query), variables["after"]),
+	}, nil
+}
+
+// owner returns one page of the repositories of the login variable, which
+// are listed by name.
+func (s *Server) owner(variables map[string]interface{}) (interface{}, []gqlError) {
+	login, _ := variables["login"].(string)
+	var names []string
+	found := false
+	for _, r := range s.repos {
+		if !strings.EqualFold(r.Owner, login) {
+			continue
+		}
+		found = true
+		if isFork, ok := variables["isFork"].(bool); ok && r.Fork != isFork {
+			continue
+		}
+		if privacy, ok := variables["privacy"].(string); ok && r.Private != (privacy == "PRIVATE") {
+			continue
+		}
+		names = append(names, r.Name)
+	}
+	if !found {
+		return nil, []gqlError{{
+			Type:    "NOT_FOUND",
+			Path:    []interface{}{"repositoryOwner"},
+			Message: "Could not resolve to a RepositoryOwner with the login of '" + login + "'.",
+		}}
+	}
+	sort.Strings(names)
+
+	start, end, pageInfo := page(len(names), 100, variables["after"])
+	nodes := make([]interface{}, 0, end-start)
+	for _, name := range names[start:end] {
+		nodes = append(nodes, map[string]interface{}{
+			"name":       name,
+			"isArchived": s.repos[repoKey(login, name)].Archived,
+		})
+	}
+	return map[string]interface{}{
+		"repositories": map[string]interface{}{"pageInfo": pageInfo, "nodes": nodes},
+	}, nil
+}
+
+// search returns one page of the repositories matching the words of the
+// query variable, in their name or description. The qualifiers, such as
+// stars:>10, are ignored.
+func (s *Server) search(variables map[string]interface{}) interface{} {
+	query, _ := variables["query"].(string)
+	var names []string
+	for _, r := range s.repos {
+		text := strings.ToLower(r.Owner + "/" + r.Name + " " + r.Description)
+		match := true
+		for _, word := range strings.Fields(strings.ToLower(query)) {
+			if !strings.Contains(word, ":") && !strings.Contains(text, word) {
+				match = false
+				break
+			}
+		}
+		if match {
+			names = append(names, r.Owner+"/"+r.Name)
+		}
+	}
+	sort.Strings(names)
+
+	first, _ := variables["first"].(float64)
+	start, end, pageInfo := page(len(names), int(first), variables["after"])
+	nodes := make([]interface{}, 0, end-start)
+	for _, name := range names[start:end] {
+		nodes = append(nodes, map[string]interface{}{"nameWithOwner": name})
+	}
+	return map[string]interface{}{"pageInfo": pageInfo, "nodes": nodes}
+}
+
+// page returns the bounds of a page of n items, and its pageInfo. The
+// cursors are the offsets of the items.
+func page(n, first int, after interface{}) (int, int, map[string]interface{}) {
+	start := 0
+	if cursor, ok := after.(string); ok {
+		start, _ = strconv.Atoi(cursor)
+	}
+	if start > n {
+		start = n
+	}
+	end := start + first
+	if first <= 0 || end > n {
+		end = n
+	}
+	return start, end, map[string]interface{}{
+		"hasNextPage": end < n,
+		"endCursor":   strconv.Itoa(end),
+	}
+}
+
+func count(n int) map[string]interface{} {
+	return map[string]interface{}{"totalCount": n}
+}
+
+// named returns an object holding the value under key, or null if the value
+// is empty.
+func named(key, value string) interface{} {
+	if value == "" {
+		return nil
+	}
+	return map[string]interface{}{key: value}
+}
+
+func nullable(s string) interface{} {
+	if s == "" {
+		return nil
+	}
+	return s
+}
+
+func formatTime(t time.Time) interface{} {
+	if t.IsZero() {
+		return nil
+	}
+	return t.UTC().Format(time.RFC3339)
+}
@@ -0,0 +1,263 @@
+package ghstats
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"math"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// DefaultSample is the number of closed pull requests the health fields
+// are computed from, unless Options.Sample says otherwise.
+const DefaultSample = 20
+
+// maxPageSize is the largest page of a connection.
+const maxPageSize = 100
+
+// closedPRs is the connection of the latest closed pull requests, merged
+// or not, which are sampled for the health fields. Github can't order them
+// by closing date, the latest updated ones come first.
+const closedPRs = "closedPRs: pullRequests(states: [CLOSED, MERGED], orderBy: {field: UPDATED_AT, direction: DESC})"
+
+// oldestOpenPR is the oldest open pull request.
+const oldestOpenPR = "oldestOpenPR: pullRequests(states: OPEN, first: 1, orderBy: {field: CREATED_AT, direction: ASC})"
+
+// prLeaves are the properties of the sampled pull requests. The first
+// response is looked for in the first comments and reviews.
+var prLeaves = [][]string{
+	{"createdAt"},
+	{"mergedAt"},
+	{"author", "login"},
+	{"comments(first: 10)", "nodes", "author", "login"},
+	{"comments(first: 10)", "nodes", "createdAt"},
+	{"reviews(first: 10)", "nodes", "author", "login"},
+	{"reviews(first: 10)", "nodes", "createdAt"},
+}
+
+// pageArguments adds the page size, and the cursor variable if any, to the
+// arguments of a connection selection.
+func pageArguments(selection string, pageSize int, after string) string {
+	args := fmt.Sprintf("first: %d, ", pageSize)
+	if after != "" {
+		args += "after: $" + after + ", "
+	}
+	return strings.Replace(selection, "(", "("+args, 1)
+}
+
+// pageQueryTemplate queries the next page of a sampled connection of a
+// repository. The selection set is generated from the queried fields.
+const pageQueryTemplate = `query($owner: String!, $name: String!, $after: String!) {
+	repository(owner: $owner, name: $name) {
+%s	}
+	rateLimit {
+		limit
+		cost
+		remaining
+		resetAt
+	}
+}`
+
+// connectionPager pages through a sampled connection of the repositories.
+type connectionPager struct {
+	// key is the response key of the connection, and query the query of
+	// its next page.
+	key   string
+	query string
+}
+
+// connectionPagers returns the pagers of the sampled connections of the
+// fields.
+func connectionPagers(fields []*Field, pageSize int) []*connectionPager {
+	var pagers []*connectionPager
+	sets := make(map[string]*selection)
+	for _, f := range fields {
+		if !f.sampled {
+			continue
+		}
+		key := responseKey(f.path[0])
+		set, ok := sets[key]
+		if !ok {
+			set = &selection{}
+			sets[key] = set
+			pagers = append(pagers, &connectionPager{key: key})
+		}
+		for _, path := range f.selectionPaths(pageSize, "after") {
+			set.add(path)
+		}
+	}
+
+	for _, p := range pagers {
+		var b strings.Builder
+		sets[p.key].render(&b, 2)
+		p.query = fmt.Sprintf(pageQueryTemplate, b.String())
+	}
+	return pagers
+}
+
+// connection receives a page of a sampled connection.
+type connection struct {
+	PageInfo struct {
+		HasNextPage bool   `json:"hasNextPage"`
+		EndCursor   string `json:"endCursor"`
+	} `json:"pageInfo"`
+	Nodes []interface{} `json:"nodes"`
+}
+
+// followPages pages through the sampled connections of a decoded
+// repository until the sample size is reached, and merges the nodes into
+// the first page.
+func (client *Client) followPages(ctx context.Context, ref RepoRef, repo map[string]interface{}) error {
+	for _, p := range client.pagers {
+		raw, ok := repo[p.key].(map[string]interface{})
+		if !ok {
+			continue
+		}
+		var conn connection
+		if err := remarshal(raw, &conn); err != nil {
+			return err
+		}
+
+		for conn.PageInfo.HasNextPage && len(conn.Nodes) < client.sample {
+			variables := map[string]interface{}{
+				"owner": ref.Owner,
+				"name":  ref.Name,
+				"after": conn.PageInfo.EndCursor,
+			}
+			out, err := client.post(ctx, p.query, variables)
+			if err != nil {
+				return err
+			}
+			if len(out.Errors) > 0 {
+				return classifyGraphQLErrors(out.Errors)
+			}
+
+			var page map[string]*connection
+			if raw := out.Data["repository"]; len(raw) > 0 {
+				if err := json.Unmarshal(raw, &page); err != nil {
+					return errors.Wrap(err, "json decode failed")
+				}
+			}
+			next := page[p.key]
+			if next == nil {
+				return errors.Errorf("query error: empty %s page", p.key)
+			}
+			conn.Nodes = append(conn.Nodes, next.Nodes...)
+			conn.PageInfo = next.PageInfo
+		}
+
+		if len(conn.Nodes) > client.sample {
+			conn.Nodes = conn.Nodes[:client.sample]
+		}
+		raw["nodes"] = conn.Nodes
+	}
+	return nil
+}
+
+// remarshal converts a decoded JSON value to v.
+func remarshal(in interface{}, v interface{}) error {
+	b, err := json.Marshal(in)
+	if err != nil {
+		return errors.Wrap(err, "json encode failed")
+	}
+	return errors.Wrap(json.Unmarshal(b, v), "json decode failed")
+}
+
+// medianResponseHours returns the median number of hours between the
+// opening of the pull requests and their first comment or review by
+// someone else than their author. The pull requests which got no response
+// are left out.
+func medianResponseHours(prs []interface{}) interface{} {
+	var hours []float64
+	for _, v := range prs {
+		pr, _ := v.(map[string]interface{})
+		created, ok := parseTime(pr["createdAt"])
+		if !ok {
+			continue
+		}
+		author := login(pr["author"])
+
+		var first time.Time
+		for _, conn := range []string{"comments", "reviews"} {
+			for _, c := range walk(pr, []string{conn, "nodes"}) {
+				node, _ := c.(map[string]interface{})
+				if author != "" && login(node["author"]) == author {
+					continue
+				}
+				if t, ok := parseTime(node["createdAt"]); ok && (first.IsZero() || t.Before(first)) {
+					first = t
+				}
+			}
+		}
+		if !first.IsZero() {
+			hours = append(hours, first.Sub(created).Hours())
+		}
+	}
+	return median(hours)
+}
+
+// medianMergeHours returns the median number of hours between the opening
+// of the pull requests and their merge. The pull requests closed without
+// being merged are left out.
+func medianMergeHours(prs []interface{}) interface{} {
+	var hours []float64
+	for _, v := range prs {
+		pr, _ := v.(map[string]interface{})
+		created, ok := parseTime(pr["createdAt"])
+		if !ok {
+			continue
+		}
+		if merged, ok := parseTime(pr["mergedAt"]); ok {
+			hours = append(hours, merged.Sub(created).Hours())
+		}
+	}
+	return median(hours)
+}
+
+// ageDays returns the number of days since the first date.
+func ageDays(dates []interface{}) interface{} {
+	if len(dates) == 0 {
+		return nil
+	}
+	t, ok := parseTime(dates[0])
+	if !ok {
+		return nil
+	}
+	return round(time.Since(t).Hours() / 24)
+}
+
+// median returns the median of the values rounded to a tenth, or nil if
+// there are none.
+func median(values []float64) interface{} {
+	if len(values) == 0 {
+		return nil
+	}
+	sort.Float64s(values)
+	m := values[len(values)/2]
+	if len(values)%2 == 0 {
+		m = (values[len(values)/2-1] + m) / 2
+	}
+	return round(m)
+}
+
+// round rounds a value to a tenth.
+func round(v float64) float64 {
+	return math.Floor(v*10+0.5) / 10
+}
+
+func parseTime(v interface{}) (time.Time, bool) {
+	s, _ := v.(string)
+	t, err := time.Parse(time.RFC3339, s)
+	return t, err == nil
+}
+
+// login returns the login of an actor, which is empty for deleted users.
+func login(actor interface{}) string {
+	a, _ := actor.(map[string]interface{})
+	s, _ := a["login"].(string)
+	return s
+}
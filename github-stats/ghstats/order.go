@@ -0,0 +1,303 @@
+package ghstats
+
+import (
+	"container/heap"
+	"encoding/gob"
+	"io"
+	"io/ioutil"
+	"os"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// SortKeys lists the supported sort keys, the first one is the default.
+var SortKeys = []string{"input", "name", "date", "author"}
+
+// orderer receives the results in arrival order, and passes them to a
+// formatter in the requested order.
+type orderer interface {
+	// add receives a result.
+	add(stats *RepoStats) error
+
+	// skip receives the sequence number of an input which will never
+	// produce a result.
+	skip(seq int) error
+
+	// flush passes the remaining results to the formatter.
+	flush() error
+}
+
+// newOrderer returns the orderer for the given sort key and direction.
+func newOrderer(key string, desc bool, f formatter) orderer {
+	if key == "input" && !desc {
+		return &sequencer{f: f, pending: make(map[int]*RepoStats), skipped: make(map[int]bool)}
+	}
+	return &sorter{f: f, less: lessFunc(key, desc)}
+}
+
+// sequencer restores the input order on the fly. A result is held back only
+// until the results of all the preceding inputs have arrived, so it uses as
+// much memory as the number of inputs in flight, which Query bounds with
+// its window.
+type sequencer struct {
+	f       formatter
+	next    int
+	pending map[int]*RepoStats
+	skipped map[int]bool
+}
+
+func (s *sequencer) add(stats *RepoStats) error {
+	s.pending[stats.seq] = stats
+	return s.drain()
+}
+
+func (s *sequencer) skip(seq int) error {
+	s.skipped[seq] = true
+	return s.drain()
+}
+
+// drain writes the results which are next in sequence.
+func (s *sequencer) drain() error {
+	for {
+		if s.skipped[s.next] {
+			delete(s.skipped, s.next)
+		} else if stats, ok := s.pending[s.next]; ok {
+			delete(s.pending, s.next)
+			if err := s.f.record(stats); err != nil {
+				return err
+			}
+		} else {
+			return nil
+		}
+		s.next++
+	}
+}
+
+// flush writes the results still held back, in sequence, should an input
+// never have been accounted for.
+func (s *sequencer) flush() error {
+	seqs := make([]int, 0, len(s.pending))
+	for seq := range s.pending {
+		seqs = append(seqs, seq)
+	}
+	sort.Ints(seqs)
+	for _, seq := range seqs {
+		if err := s.f.record(s.pending[seq]); err != nil {
+			return err
+		}
+		delete(s.pending, seq)
+	}
+	return nil
+}
+
+// sortBufferSize is the number of results sorted in memory. Beyond that,
+// sorted runs are spilled to temporary files and merged at the end.
+const sortBufferSize = 10000
+
+// sorter sorts the results with an external merge sort.
+type sorter struct {
+	f      formatter
+	less   func(a, b *RepoStats) bool
+	buffer []*RepoStats
+	runs   []*os.File
+}
+
+// spilledStats is the on-disk form of a result, which keeps its sequence
+// number.
+type spilledStats struct {
+	Seq   int
+	Stats *RepoStats
+}
+
+func (s *sorter) add(stats *RepoStats) error {
+	s.buffer = append(s.buffer, stats)
+	if len(s.buffer) >= sortBufferSize {
+		return s.spill()
+	}
+	return nil
+}
+
+func (s *sorter) skip(seq int) error {
+	return nil
+}
+
+func (s *sorter) sort() {
+	sort.SliceStable(s.buffer, func(i, j int) bool {
+		return s.less(s.buffer[i], s.buffer[j])
+	})
+}
+
+// spill writes the sorted buffer to a temporary file.
+func (s *sorter) spill() error {
+	s.sort()
+
+	file, err := ioutil.TempFile("", "github-stats")
+	if err != nil {
+		return errors.Wrap(err, "create sort run failed")
+	}
+	s.runs = append(s.runs, file)
+
+	enc := gob.NewEncoder(file)
+	for _, stats := range s.buffer {
+		if err := enc.Encode(&spilledStats{stats.seq, stats}); err != nil {
+			return errors.Wrap(err, "write sort run failed")
+		}
+	}
+	s.buffer = s.buffer[:0]
+
+	_, err = file.Seek(0, io.SeekStart)
+	return err
+}
+
+func (s *sorter) flush() error {
+	defer func() {
+		for _, file := range s.runs {
+			file.Close()
+			os.Remove(file.Name())
+		}
+	}()
+
+	// Everything fits in memory.
+	if len(s.runs) == 0 {
+		s.sort()
+		for _, stats := range s.buffer {
+			if err := s.f.record(stats); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+
+	if len(s.buffer) > 0 {
+		if err := s.spill(); err != nil {
+			return err
+		}
+	}
+
+	// Merge the runs, taking the least head among them every time.
+	h := &runHeap{less: s.less}
+	for _, file := range s.runs {
+		r := &run{dec: gob.NewDecoder(file)}
+		if err := r.next(); err != nil {
+			return err
+		}
+		if r.head != nil {
+			h.runs = append(h.runs, r)
+		}
+	}
+	heap.Init(h)
+
+	for h.Len() > 0 {
+		r := h.runs[0]
+		if err := s.f.record(r.head); err != nil {
+			return err
+		}
+		if err := r.next(); err != nil {
+			return err
+		}
+		if r.head == nil {
+			heap.Pop(h)
+		} else {
+			heap.Fix(h, 0)
+		}
+	}
+	return nil
+}
+
+// run reads a spilled run back one result at a time.
+type run struct {
+	dec  *gob.Decoder
+	head *RepoStats
+}
+
+// next reads the next result into head, which is nil at the end of the run.
+func (r *run) next() error {
+	var spilled spilledStats
+	err := r.dec.Decode(&spilled)
+	if err == io.EOF {
+		r.head = nil
+		return nil
+	}
+	if err != nil {
+		return errors.Wrap(err, "read sort run failed")
+	}
+	r.head = spilled.Stats
+	r.head.seq = spilled.Seq
+	return nil
+}
+
+// runHeap implements heap.Interface over the heads of the runs.
+type runHeap struct {
+	runs []*run
+	less func(a, b *RepoStats) bool
+}
+
+func (h *runHeap) Len() int           { return len(h.runs) }
+func (h *runHeap) Less(i, j int) bool { return h.less(h.runs[i].head, h.runs[j].head) }
+func (h *runHeap) Swap(i, j int)      { h.runs[i], h.runs[j] = h.runs[j], h.runs[i] }
+
+func (h *runHeap) Push(x interface{}) {
+	h.runs = append(h.runs, x.(*run))
+}
+
+func (h *runHeap) Pop() interface{} {
+	r := h.runs[len(h.runs)-1]
+	h.runs = h.runs[:len(h.runs)-1]
+	return r
+}
+
+// lessFunc returns the comparison for the given sort key and direction.
+// Ties are broken by the input order, so that sorting is stable even
+// across spilled runs.
+func lessFunc(key string, desc bool) func(a, b *RepoStats) bool {
+	var compare func(a, b *RepoStats) int
+	switch key {
+	case "name":
+		compare = func(a, b *RepoStats) int {
+			return strings.Compare(strings.ToLower(a.Name), strings.ToLower(b.Name))
+		}
+	case "date":
+		compare = func(a, b *RepoStats) int {
+			return compareDates(a.CommitDate, b.CommitDate)
+		}
+	case "author":
+		compare = func(a, b *RepoStats) int {
+			return strings.Compare(strings.ToLower(a.AuthorName), strings.ToLower(b.AuthorName))
+		}
+	default:
+		compare = func(a, b *RepoStats) int {
+			return 0
+		}
+	}
+
+	return func(a, b *RepoStats) bool {
+		c := compare(a, b)
+		if c == 0 {
+			c = a.seq - b.seq
+		}
+		if desc {
+			return c > 0
+		}
+		return c < 0
+	}
+}
+
+// compareDates compares two RFC3339 dates by the instants they represent,
+// falling back to comparing the strings if either of them is malformed.
+func compareDates(a, b string) int {
+	ta, errA := time.Parse(time.RFC3339, a)
+	tb, errB := time.Parse(time.RFC3339, b)
+	if errA != nil || errB != nil {
+		return strings.Compare(a, b)
+	}
+	switch {
+	case ta.Before(tb):
+		return -1
+	case ta.After(tb):
+		return 1
+	}
+	return 0
+}
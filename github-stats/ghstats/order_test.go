@@ -0,0 +1,197 @@
+package ghstats
+
+import (
+	"fmt"
+	"reflect"
+	"testing"
+)
+
+// recordedFormatter keeps the results it is passed, in order.
+type recordedFormatter struct {
+	records []*RepoStats
+}
+
+func (f *recordedFormatter) record(stats *RepoStats) error {
+	f.records = append(f.records, stats)
+	return nil
+}
+
+func (f *recordedFormatter) finish(r *Report) error {
+	return nil
+}
+
+// seqs returns the sequence numbers of the recorded results.
+func (f *recordedFormatter) seqs() []int {
+	seqs := make([]int, len(f.records))
+	for i, stats := range f.records {
+		seqs[i] = stats.seq
+	}
+	return seqs
+}
+
+func testStats(seq int, name, date, author string) *RepoStats {
+	stats := newRepoStats(map[string]interface{}{
+		"name":              name,
+		"url":               "https://github.com/octocat/" + name,
+		"lastCommit.date":   date,
+		"lastCommit.author": author,
+	})
+	stats.seq = seq
+	return stats
+}
+
+func TestCompareDates(t *testing.T) {
+	tests := []struct {
+		a, b string
+		want int
+	}{
+		{"2018-05-01T10:00:00Z", "2018-05-01T10:00:00Z", 0},
+		{"2018-05-01T10:00:00Z", "2018-05-02T10:00:00Z", -1},
+		{"2018-05-02T10:00:00Z", "2018-05-01T10:00:00Z", 1},
+		// The same instant in different time zones.
+		{"2018-05-01T12:00:00+02:00", "2018-05-01T10:00:00Z", 0},
+		// Compared as strings, they would be in the wrong order.
+		{"2018-05-01T09:00:00-05:00", "2018-05-01T12:00:00Z", 1},
+		// Malformed dates are compared as strings.
+		{"", "2018-05-01T10:00:00Z", -1},
+		{"not a date", "2018-05-01T10:00:00Z", 1},
+	}
+
+	for _, tt := range tests {
+		if got := compareDates(tt.a, tt.b); got != tt.want {
+			t.Errorf("compareDates(%q, %q) = %d, want %d", tt.a, tt.b, got, tt.want)
+		}
+	}
+}
+
+func TestLessFunc(t *testing.T) {
+	a := testStats(0, "Beta", "2018-05-02T10:00:00Z", "alice")
+	b := testStats(1, "alpha", "2018-05-01T10:00:00Z", "Bob")
+	c := testStats(2, "beta", "2018-05-02T10:00:00Z", "carol")
+
+	tests := []struct {
+		key  string
+		desc bool
+		x, y *RepoStats
+		want bool
+	}{
+		{"input", false, a, b, true},
+		{"input", true, a, b, false},
+		{"name", false, b, a, true},
+		{"name", false, a, b, false},
+		{"name", true, a, b, true},
+		// Ties are broken by the input order, even in descending order.
+		{"name", false, a, c, true},
+		{"name", true, a, c, false},
+		{"date", false, b, a, true},
+		{"date", true, a, b, true},
+		{"date", false, a, c, true},
+		{"author", false, a, b, true},
+		{"author", false, b, c, true},
+		{"author", true, c, b, true},
+	}
+
+	for _, tt := range tests {
+		if got := lessFunc(tt.key, tt.desc)(tt.x, tt.y); got != tt.want {
+			t.Errorf("lessFunc(%q, %t)(%s#%d, %s#%d) = %t, want %t", tt.key, tt.desc, tt.x.Name, tt.x.seq, tt.y.Name, tt.y.seq, got, tt.want)
+		}
+	}
+}
+
+func TestSequencer(t *testing.T) {
+	f := &recordedFormatter{}
+	o := newOrderer("input", false, f)
+
+	steps := []struct {
+		add  int
+		skip int
+		want []int
+	}{
+		{add: 2, want: []int{}},
+		{add: 0, want: []int{0}},
+		{skip: 1, want: []int{0, 2}},
+		{add: 4, want: []int{0, 2}},
+		{skip: 3, want: []int{0, 2, 4}},
+		{add: 5, want: []int{0, 2, 4, 5}},
+	}
+	for i, step := range steps {
+		var err error
+		if step.skip > 0 {
+			err = o.skip(step.skip)
+		} else {
+			err = o.add(testStats(step.add, "r", "", ""))
+		}
+		if err != nil {
+			t.Fatalf("step %d failed: %s", i, err)
+		}
+		if got := f.seqs(); !reflect.DeepEqual(got, step.want) {
+			t.Errorf("after step %d, written %v, want %v", i, got, step.want)
+		}
+	}
+}
+
+func TestSequencerFlush(t *testing.T) {
+	f := &recordedFormatter{}
+	o := newOrderer("input", false, f)
+
+	// The result 1 never arrives, the ones after it are written once
+	// flushed.
+	for _, seq := range []int{4, 0, 3, 2} {
+		if err := o.add(testStats(seq, "r", "", "")); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if got := f.seqs(); !reflect.DeepEqual(got, []int{0}) {
+		t.Fatalf("written %v before the flush, want [0]", got)
+	}
+	if err := o.flush(); err != nil {
+		t.Fatal(err)
+	}
+	if got := f.seqs(); !reflect.DeepEqual(got, []int{0, 2, 3, 4}) {
+		t.Errorf("written %v, want [0 2 3 4]", got)
+	}
+}
+
+func TestSorter(t *testing.T) {
+	tests := []struct {
+		name string
+		n    int
+	}{
+		{"in memory", 100},
+		{"spilled", 2*sortBufferSize + 500},
+	}
+
+	for _, tt := range tests {
+		f := &recordedFormatter{}
+		o := newOrderer("name", true, f)
+		for i := 0; i < tt.n; i++ {
+			// Names repeat, so that the ties are broken by the input order.
+			stats := testStats(i, fmt.Sprintf("repo-%03d", (i*7919)%1000), "2018-05-01T10:00:00Z", "alice")
+			stats.Values["topics"] = []string{"go", "cli"}
+			stats.Values["stars"] = float64(i)
+			if err := o.add(stats); err != nil {
+				t.Fatalf("%s: add failed: %s", tt.name, err)
+			}
+		}
+		if err := o.flush(); err != nil {
+			t.Fatalf("%s: flush failed: %s", tt.name, err)
+		}
+
+		if len(f.records) != tt.n {
+			t.Fatalf("%s: written %d results, want %d", tt.name, len(f.records), tt.n)
+		}
+		less := lessFunc("name", true)
+		for i := 1; i < len(f.records); i++ {
+			if !less(f.records[i-1], f.records[i]) {
+				t.Fatalf("%s: %s#%d written before %s#%d", tt.name, f.records[i-1].Name, f.records[i-1].seq, f.records[i].Name, f.records[i].seq)
+			}
+		}
+
+		// The values survive the spilled runs.
+		for _, stats := range f.records {
+			if !reflect.DeepEqual(stats.Values["topics"], []string{"go", "cli"}) || stats.Values["stars"] != float64(stats.seq) {
+				t.Fatalf("%s: values of %s#%d = %v", tt.name, stats.Name, stats.seq, stats.Values)
+			}
+		}
+	}
+}
@@ -0,0 +1,606 @@
+package ghstats
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Hosts returns the Querier of the repositories of a Github host, the empty
+// host standing for the default endpoint.
+type Hosts func(host string) (Querier, error)
+
+// SingleHost returns the Hosts querying all the repositories with q,
+// whatever their host.
+func SingleHost(q Querier) Hosts {
+	return func(host string) (Querier, error) {
+		return q, nil
+	}
+}
+
+// InputError represents an error occurred when accepting user input.
+type InputError struct {
+	seq   int
+	Input string
+	Err   error
+}
+
+// QueryError represents an error occurred when requesting to Github API.
+type QueryError struct {
+	seq   int
+	Input string
+	Err   error
+}
+
+// InputOptions configures Input.
+type InputOptions struct {
+	// DefaultBranch is the branch of the inputs which don't specify one.
+	// If empty, the default branch of each repository is queried.
+	DefaultBranch string
+
+	// Expand selects the repositories $orgname/* is expanded into.
+	Expand OwnerFilter
+
+	// Search is the search query of the repositories to query besides
+	// the input, and SearchLimit is the maximum number of search results.
+	Search      string
+	SearchLimit int
+}
+
+// Input reads the repository list from r, which may be nil, after the
+// results of the search query if it is set. The search is run against the
+// default endpoint. It stops once ctx is done.
+func Input(ctx context.Context, r io.Reader, hosts Hosts, opts InputOptions) (<-chan RepoRef, <-chan InputError) {
+	in := make(chan RepoRef)
+	errc := make(chan InputError)
+	go func() {
+		defer close(in)
+		defer close(errc)
+
+		// This map is used to remove duplicates. The names of the owners
+		// and of the repositories are case insensitive, unlike the ones
+		// of the branches.
+		uniqueMap := make(map[string]struct{})
+
+		// Every unique input is tagged with a sequence number, so that the
+		// output can be ordered as the input.
+		seq := 0
+
+		// send sends ref to the input channel, unless it is duplicated.
+		// Once ctx is done, it is reported as skipped instead, so that the
+		// summary accounts for it.
+		send := func(ref RepoRef) {
+			key := repoKey(ref, "") + "@" + ref.Branch
+			if _, ok := uniqueMap[key]; ok {
+				return
+			}
+			uniqueMap[key] = struct{}{}
+			ref.seq, ref.sequenced = seq, true
+			seq++
+			select {
+			case in <- ref:
+			case <-ctx.Done():
+				errc <- InputError{ref.seq, ref.String(), &cancelledError{ctx.Err()}}
+			}
+		}
+
+		// fail sends an error to the error channel.
+		fail := func(s string, err error) {
+			errc <- InputError{seq, s, err}
+			seq++
+		}
+
+		// Search for repositories, if requested.
+		if opts.Search != "" {
+			client, err := hosts("")
+			if err == nil {
+				err = client.SearchRepositories(ctx, opts.Search, opts.SearchLimit, func(nameWithOwner string) {
+					ref, err := ParseRepoRef(nameWithOwner, opts.DefaultBranch)
+					if err != nil {
+						fail(nameWithOwner, err)
+						return
+					}
+					send(ref)
+				})
+			}
+			if err != nil && ctx.Err() == nil {
+				fail("search: "+opts.Search, err)
+			}
+		}
+
+		if r == nil {
+			return
+		}
+
+		// Scan in a separate goroutine, as reading from stdin can not be
+		// interrupted.
+		lines := make(chan string)
+		go func() {
+			defer close(lines)
+			scanner := bufio.NewScanner(r)
+			for scanner.Scan() {
+				select {
+				case lines <- scanner.Text():
+				case <-ctx.Done():
+					return
+				}
+			}
+		}()
+
+		// Read from stdin, until EOF.
+		for {
+			var s string
+			select {
+			case line, ok := <-lines:
+				if !ok {
+					return
+				}
+				s = strings.TrimSpace(line)
+			case <-ctx.Done():
+				return
+			}
+
+			// Empty?
+			if s == "" {
+				continue
+			}
+
+			// Invalid?
+			ref, err := ParseRepoRef(s, opts.DefaultBranch)
+			if err != nil {
+				fail(s, err)
+				continue
+			}
+
+			// Wildcard? Expand it into all the repositories of the owner,
+			// as if they were typed one per line.
+			if ref.IsWildcard() {
+				client, err := hosts(ref.Host)
+				if err == nil {
+					err = client.ListRepositories(ctx, ref.Owner, opts.Expand, func(name string) {
+						expanded := ref
+						expanded.Name = name
+						send(expanded)
+					})
+				}
+				if err != nil && ctx.Err() == nil {
+					fail(s, err)
+				}
+				continue
+			}
+
+			send(ref)
+		}
+	}()
+	return in, errc
+}
+
+// batchLinger is how long to wait for more input before sending a batch
+// which is not full yet.
+const batchLinger = 100 * time.Millisecond
+
+// batch groups the input into batches of at most size repositories. All
+// the repositories of a batch live on the same host.
+func batch(in <-chan RepoRef, size int) <-chan []RepoRef {
+	batches := make(chan []RepoRef)
+	go func() {
+		defer close(batches)
+		for ref := range in {
+			// pending holds the batches which are not full yet, by host.
+			pending := map[string][]RepoRef{ref.Host: {ref}}
+			hosts := []string{ref.Host}
+			timer := time.NewTimer(batchLinger)
+
+		collect:
+			for len(pending[ref.Host]) < size {
+				select {
+				case next, ok := <-in:
+					if !ok {
+						break collect
+					}
+					if _, ok := pending[next.Host]; !ok {
+						hosts = append(hosts, next.Host)
+					}
+					pending[next.Host] = append(pending[next.Host], next)
+					ref = next
+				case <-timer.C:
+					break collect
+				}
+			}
+
+			// The batch of the last host may be full, the others are
+			// sent as they are, in the order of their first input.
+			timer.Stop()
+			for _, host := range hosts {
+				batches <- pending[host]
+			}
+		}
+	}()
+	return batches
+}
+
+// minWindow is the least number of inputs a Query lets in past the oldest
+// one whose query has not completed yet.
+const minWindow = 1000
+
+// window bounds the number of inputs let in past the oldest one in flight.
+// The results are written in the input order, so the ones which complete
+// after it are held back until it does: the window keeps their number,
+// and the memory they take, bounded whatever the length of the input.
+type window struct {
+	mu   sync.Mutex
+	cond *sync.Cond
+	size int
+
+	// next is the number of inputs let in so far, and oldest the index
+	// of the oldest one in flight. index maps the sequence numbers of the
+	// inputs in flight to their index, and done holds the indexes of the
+	// completed ones past oldest.
+	next   int
+	oldest int
+	index  map[int]int
+	done   map[int]bool
+}
+
+func newWindow(size int) *window {
+	w := &window{size: size, index: make(map[int]int), done: make(map[int]bool)}
+	w.cond = sync.NewCond(&w.mu)
+	return w
+}
+
+// enter blocks until the input fits in the window.
+func (w *window) enter(ref RepoRef) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	for w.next-w.oldest >= w.size {
+		w.cond.Wait()
+	}
+	w.index[ref.seq] = w.next
+	w.next++
+}
+
+// leave records that the queries of the inputs completed, and slides the
+// window past the oldest ones.
+func (w *window) leave(refs []RepoRef) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	for _, ref := range refs {
+		w.done[w.index[ref.seq]] = true
+		delete(w.index, ref.seq)
+	}
+	for w.done[w.oldest] {
+		delete(w.done, w.oldest)
+		w.oldest++
+	}
+	w.cond.Broadcast()
+}
+
+// QueryOptions configures Query.
+type QueryOptions struct {
+	// Concurrency is the number of workers querying the API, at least 1.
+	Concurrency int
+
+	// RPS caps the number of queries issued per second, 0 means no cap.
+	RPS float64
+
+	// BatchSize is the number of repositories queried per request, at
+	// least 1.
+	BatchSize int
+
+	// GracePeriod is how long the in-flight queries are given to complete
+	// once ctx is done.
+	GracePeriod time.Duration
+}
+
+// Query queries the repositories from the input channel. Once ctx is done,
+// the remaining input is skipped, and the in-flight queries are given
+// the grace period to complete. The input is read at most a window of
+// inputs ahead of the oldest query in flight, so that the results held
+// back to restore the input order don't pile up behind a slow query.
+//
+// The input may come from Input, or be built by the caller, e.g. with
+// ParseRepoRef, in which case the repositories are numbered in the order
+// they are received. A channel should not mix both.
+func Query(ctx context.Context, hosts Hosts, in <-chan RepoRef, opts QueryOptions) (<-chan *RepoStats, <-chan QueryError) {
+	out := make(chan *RepoStats)
+	errc := make(chan QueryError)
+	if opts.Concurrency < 1 {
+		opts.Concurrency = 1
+	}
+	if opts.BatchSize < 1 {
+		opts.BatchSize = 1
+	}
+
+	go func() {
+		defer close(out)
+		defer close(errc)
+		var wg sync.WaitGroup
+
+		lim := newLimiter(opts.RPS)
+		defer lim.stop()
+
+		reqCtx, cancel := withGrace(ctx, opts.GracePeriod)
+		defer cancel()
+
+		// Let the input in as the window slides.
+		size := 2 * opts.Concurrency * opts.BatchSize
+		if size < minWindow {
+			size = minWindow
+		}
+		win := newWindow(size)
+		windowed := make(chan RepoRef)
+		go func() {
+			defer close(windowed)
+			n := 0
+			for ref := range in {
+				if !ref.sequenced {
+					ref.seq, ref.sequenced = n, true
+					n++
+				}
+				win.enter(ref)
+				windowed <- ref
+			}
+		}()
+
+		batches := batch(windowed, opts.BatchSize)
+
+		// Start a fixed number of workers, all of them consuming the same
+		// batch channel.
+		for i := 0; i < opts.Concurrency; i++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				for refs := range batches {
+					query(ctx, reqCtx, lim, hosts, refs, out, errc)
+					win.leave(refs)
+				}
+			}()
+		}
+
+		wg.Wait()
+	}()
+	return out, errc
+}
+
+// query queries a batch of repositories, and sends the results and the
+// errors. reqCtx bounds the query, while ctx tells whether the run was
+// cancelled.
+func query(ctx, reqCtx context.Context, lim *limiter, hosts Hosts, refs []RepoRef, out chan<- *RepoStats, errc chan<- QueryError) {
+	// Skip the remaining input once the run is cancelled.
+	if err := lim.wait(ctx); err != nil {
+		for _, ref := range refs {
+			errc <- QueryError{ref.seq, ref.String(), &cancelledError{err}}
+		}
+		return
+	}
+
+	client, err := hosts(refs[0].Host)
+	if err != nil {
+		for _, ref := range refs {
+			errc <- QueryError{ref.seq, ref.String(), err}
+		}
+		return
+	}
+
+	stats, errs := client.QueryBatch(reqCtx, refs)
+	for i, ref := range refs {
+		if errs[i] != nil {
+			// Queries which did not complete within the grace period
+			// are skipped rather than failed.
+			if reqCtx.Err() != nil {
+				errs[i] = &cancelledError{ctx.Err()}
+			}
+			errc <- QueryError{ref.seq, ref.String(), errs[i]}
+			continue
+		}
+		out <- stats[i]
+	}
+}
+
+// OutputOptions configures Output.
+type OutputOptions struct {
+	// Format is one of Formats, and Fields are the fields to write,
+	// DefaultFields if empty.
+	Format string
+	Fields []*Field
+
+	// Sort is one of SortKeys, and Desc reverses the order.
+	Sort string
+	Desc bool
+
+	// ShowErrors and ShowSummary tell whether the errors and the summary
+	// are written after the results.
+	ShowErrors  bool
+	ShowSummary bool
+
+	// Stale, if set, tells the freshness of the results, which is
+	// written.
+	Stale *StalePolicy
+
+	// Diff, if set, compares the results with a previous run, and only
+	// the changes are written, unless ShowUnchanged is set.
+	Diff          *Differ
+	ShowUnchanged bool
+
+	// TokenUsage, if set, is called once the results are written, to
+	// report the use of the tokens in the summary, see Client.TokenUsage.
+	TokenUsage func() []TokenUsage
+
+	// Log receives the notices of the run, e.g. the write errors. They
+	// are discarded if it is nil.
+	Log io.Writer
+}
+
+// Output writes the results, the errors and the summary to w. It consumes
+// all the channels until they are closed, even if ctx is done, so that
+// partial results are written as well. The report is sent once everything
+// is written.
+func Output(ctx context.Context, w io.Writer, out <-chan *RepoStats, ie <-chan InputError, qe <-chan QueryError, opts OutputOptions) <-chan *Report {
+	done := make(chan *Report, 1)
+	go func() {
+		p, d := opts.Stale, opts.Diff
+		log := opts.Log
+		if log == nil {
+			log = ioutil.Discard
+		}
+
+		fields := opts.Fields
+		if len(fields) == 0 {
+			fields = DefaultFields()
+		}
+		if p != nil {
+			fields = append([]*Field{freshnessField}, fields...)
+		}
+		if d != nil {
+			fields = append([]*Field{statusField}, fields...)
+		}
+		f := newFormatter(opts.Format, w, fields)
+		o := newOrderer(opts.Sort, opts.Desc, f)
+		r := &Report{showErrors: opts.ShowErrors, showSummary: opts.ShowSummary}
+
+		// skip accounts for an input skipped because of an exhausted rate
+		// limit budget or a cancellation. They are reported as a whole
+		// rather than one by one.
+		skip := func(seq int, input string, err error) {
+			r.SkipErr = err
+			r.Summary.Skipped++
+			if d != nil {
+				d.skipped(input)
+			}
+			if err := o.skip(seq); err != nil {
+				fmt.Fprintf(log, "write error: %s\n", err)
+			}
+		}
+
+		// Consume all the channels until they are closed. A closed channel
+		// is set to nil, so that it is never selected again.
+		for out != nil || ie != nil || qe != nil {
+			select {
+			case stats, ok := <-out:
+				if !ok {
+					out = nil
+					continue
+				}
+				r.Summary.Total++
+				r.Summary.Succeeded++
+				if stats.cached {
+					r.Summary.Cached++
+				}
+				if len(stats.warnings) > 0 {
+					r.Summary.Partial++
+					for _, err := range stats.warnings {
+						r.Warnings = append(r.Warnings, QueryError{stats.seq, stats.input, err})
+					}
+				}
+				if p != nil {
+					freshness := p.freshness(stats)
+					stats.Values[freshnessField.name] = freshness
+					r.countFreshness(freshness)
+				}
+
+				// Leave the unchanged repositories out of a diff.
+				if d != nil {
+					status := d.result(stats)
+					r.countStatus(status)
+					if status == "unchanged" && !opts.ShowUnchanged {
+						if err := o.skip(stats.seq); err != nil {
+							fmt.Fprintf(log, "write error: %s\n", err)
+						}
+						continue
+					}
+				}
+				if err := o.add(stats); err != nil {
+					fmt.Fprintf(log, "write error: %s\n", err)
+				}
+
+			case e, ok := <-ie:
+				if !ok {
+					ie = nil
+					continue
+				}
+				r.Summary.Total++
+				if IsSkipped(e.Err) {
+					skip(e.seq, e.Input, e.Err)
+					continue
+				}
+				r.Summary.Failed++
+				r.InputErrors = append(r.InputErrors, e)
+				r.countClass(Classify(e.Err))
+				if d != nil {
+					d.inputFailed(e.Input)
+				}
+				if err := o.skip(e.seq); err != nil {
+					fmt.Fprintf(log, "write error: %s\n", err)
+				}
+
+			case e, ok := <-qe:
+				if !ok {
+					qe = nil
+					continue
+				}
+				r.Summary.Total++
+
+				if IsSkipped(e.Err) {
+					skip(e.seq, e.Input, e.Err)
+					continue
+				}
+				r.Summary.Failed++
+				r.QueryErrors = append(r.QueryErrors, e)
+				r.countClass(Classify(e.Err))
+
+				// Failures are part of a diff.
+				var err error
+				if d != nil {
+					stats := d.failure(e.Input)
+					stats.seq = e.seq
+					r.countStatus("error")
+					err = o.add(stats)
+				} else {
+					err = o.skip(e.seq)
+				}
+				if err != nil {
+					fmt.Fprintf(log, "write error: %s\n", err)
+				}
+			}
+		}
+
+		// The repositories of the previous run which are missing come
+		// after all the inputs. They are unknown if the run stopped early.
+		if d != nil && ctx.Err() == nil {
+			for i, stats := range d.removed() {
+				stats.seq = r.Summary.Total + i
+				r.countStatus("removed")
+				if err := o.add(stats); err != nil {
+					fmt.Fprintf(log, "write error: %s\n", err)
+				}
+			}
+		}
+
+		if err := o.flush(); err != nil {
+			fmt.Fprintf(log, "write error: %s\n", err)
+		}
+		if opts.TokenUsage != nil {
+			r.Summary.Tokens = opts.TokenUsage()
+		}
+		if err := f.finish(r); err != nil {
+			fmt.Fprintf(log, "write error: %s\n", err)
+		}
+
+		if r.Summary.Partial > 0 && !opts.ShowErrors {
+			fmt.Fprintf(log, "%d repositories have partial results, use -e to show the warnings\n", r.Summary.Partial)
+		}
+		if r.SkipErr != nil {
+			fmt.Fprintf(log, "%s\n%d repositories skipped\n", r.SkipErr, r.Summary.Skipped)
+		} else if ctx.Err() != nil {
+			fmt.Fprintf(log, "run stopped early (%s), the results may be partial\n", ctx.Err())
+		}
+
+		done <- r
+	}()
+	return done
+}
@@ -0,0 +1,367 @@
+package ghstats_test
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/yuankunzhang/devops-challenge/github-stats/ghstats"
+	"github.com/yuankunzhang/devops-challenge/github-stats/ghstats/ghstatstest"
+)
+
+var (
+	recent = time.Now().Add(-24 * time.Hour).UTC().Truncate(time.Second)
+	old    = time.Date(2015, 1, 1, 0, 0, 0, 0, time.UTC)
+)
+
+// testRepos are the repositories served by the fake in the tests.
+var testRepos = []ghstatstest.Repo{
+	{Owner: "octo", Name: "alpha", Stars: 1, PushedAt: recent, Branches: map[string]ghstatstest.Commit{"dev": {Author: "bob", Date: recent}}},
+	{Owner: "octo", Name: "beta", Stars: 2, PushedAt: old},
+	{Owner: "octo", Name: "gamma", Stars: 3, PushedAt: recent},
+	{Owner: "octo", Name: "delta", Stars: 4, PushedAt: old, Archived: true},
+	{Owner: "octo", Name: "fork", Stars: 5, PushedAt: recent, Fork: true},
+	{Owner: "other", Name: "solo", Stars: 6, PushedAt: old},
+}
+
+// run runs the pipeline on the input with the client, querying batchSize
+// repositories per request, and returns the ndjson output, split by type,
+// and the report.
+func run(t *testing.T, client *ghstats.Client, input string, batchSize int, inOpts ghstats.InputOptions, outOpts ghstats.OutputOptions) (results, errs []map[string]interface{}, r *ghstats.Report) {
+	ctx := context.Background()
+	hosts := ghstats.SingleHost(client)
+	in, ie := ghstats.Input(ctx, strings.NewReader(input), hosts, inOpts)
+	out, qe := ghstats.Query(ctx, hosts, in, ghstats.QueryOptions{Concurrency: 2, BatchSize: batchSize})
+
+	var b bytes.Buffer
+	outOpts.Format = "ndjson"
+	outOpts.Sort = "input"
+	outOpts.ShowErrors = true
+	if outOpts.Fields == nil {
+		outOpts.Fields = testFields(t, "name,url,lastCommit.date,lastCommit.author")
+	}
+	r = <-ghstats.Output(ctx, &b, out, ie, qe, outOpts)
+
+	scanner := bufio.NewScanner(&b)
+	for scanner.Scan() {
+		var record map[string]interface{}
+		if err := json.Unmarshal(scanner.Bytes(), &record); err != nil {
+			t.Fatalf("invalid output line %q: %s", scanner.Text(), err)
+		}
+		switch record["type"] {
+		case "result":
+			results = append(results, record)
+		case "error":
+			errs = append(errs, record)
+		}
+	}
+	return results, errs, r
+}
+
+func testFields(t *testing.T, names string) []*ghstats.Field {
+	fields, err := ghstats.ParseFields(names)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return fields
+}
+
+// values returns the values of a field of the records.
+func values(records []map[string]interface{}, name string) []string {
+	var values []string
+	for _, record := range records {
+		values = append(values, ghstats.FormatValue(record[name]))
+	}
+	return values
+}
+
+func TestPipeline(t *testing.T) {
+	srv := ghstatstest.NewServer(testRepos...)
+	defer srv.Close()
+	client := ghstats.NewClient(nil, srv.Endpoint(), ghstats.Options{})
+
+	input := "octo/alpha\nocto/beta\nOcto/Alpha\nnot-a-repo\nocto/missing\nocto/alpha@dev\nocto/alpha@nope\nocto/gamma\nother/solo\n"
+	results, errs, r := run(t, client, input, 3, ghstats.InputOptions{}, ghstats.OutputOptions{})
+
+	// The results are in the input order, the duplicate left out.
+	wantNames := []string{"alpha", "beta", "alpha", "gamma", "solo"}
+	if got := values(results, "name"); !reflect.DeepEqual(got, wantNames) {
+		t.Errorf("results %v, want %v", got, wantNames)
+	}
+	if got := values(results, "lastCommit.author")[2]; got != "bob" {
+		t.Errorf("author of octo/alpha@dev = %q, want bob", got)
+	}
+
+	// The missing repository and branch fail on their own, in the same
+	// batches as results. The errors are in the order they occurred.
+	wantErrs := map[string]string{"not-a-repo": "unknown", "octo/missing": "not_found", "octo/alpha@nope": "not_found"}
+	gotErrs := make(map[string]string)
+	for _, e := range errs {
+		gotErrs[ghstats.FormatValue(e["input"])] = ghstats.FormatValue(e["class"])
+	}
+	if !reflect.DeepEqual(gotErrs, wantErrs) {
+		t.Errorf("errors %v, want %v", gotErrs, wantErrs)
+	}
+	want := ghstats.Summary{Total: 8, Succeeded: 5, Failed: 3, Classes: r.Summary.Classes}
+	if !reflect.DeepEqual(r.Summary, want) {
+		t.Errorf("summary %+v, want %+v", r.Summary, want)
+	}
+
+	// 7 queried inputs in batches of 3.
+	remaining, _, _ := client.RateLimit()
+	if requests := 5000 - remaining; requests != 3 {
+		t.Errorf("sent %d requests, want 3", requests)
+	}
+}
+
+func TestPipelineCallerRefs(t *testing.T) {
+	// More refs than the window of Query, all numbered 0 by ParseRepoRef.
+	const n = 1500
+	srv := ghstatstest.NewServer()
+	defer srv.Close()
+	refs := make(chan ghstats.RepoRef)
+	go func() {
+		defer close(refs)
+		for i := 0; i < n; i++ {
+			name := fmt.Sprintf("repo-%04d", i)
+			srv.Add(ghstatstest.Repo{Owner: "octo", Name: name, PushedAt: recent})
+			ref, err := ghstats.ParseRepoRef("octo/"+name, "")
+			if err != nil {
+				panic(err)
+			}
+			refs <- ref
+		}
+	}()
+	client := ghstats.NewClient(nil, srv.Endpoint(), ghstats.Options{})
+
+	ctx := context.Background()
+	out, qe := ghstats.Query(ctx, ghstats.SingleHost(client), refs, ghstats.QueryOptions{Concurrency: 4, BatchSize: 50})
+	var b bytes.Buffer
+	done := ghstats.Output(ctx, &b, out, nil, qe, ghstats.OutputOptions{Format: "csv", Sort: "input", Fields: testFields(t, "name")})
+	select {
+	case r := <-done:
+		if r.Summary.Succeeded != n {
+			t.Fatalf("summary %+v, want %d successes", r.Summary, n)
+		}
+	case <-time.After(30 * time.Second):
+		t.Fatal("the run did not complete")
+	}
+
+	// The results are in the order the refs were sent.
+	lines := strings.Split(strings.TrimSpace(b.String()), "\n")[1:]
+	if len(lines) != n {
+		t.Fatalf("written %d results, want %d", len(lines), n)
+	}
+	for i, line := range lines {
+		if want := fmt.Sprintf("repo-%04d", i); line != want {
+			t.Fatalf("result %d is %s, want %s", i, line, want)
+		}
+	}
+}
+
+func TestPipelineExpand(t *testing.T) {
+	srv := ghstatstest.NewServer(testRepos...)
+	defer srv.Close()
+	client := ghstats.NewClient(nil, srv.Endpoint(), ghstats.Options{})
+
+	tests := []struct {
+		filter ghstats.OwnerFilter
+		want   []string
+	}{
+		{ghstats.OwnerFilter{}, []string{"alpha", "beta", "gamma"}},
+		{ghstats.OwnerFilter{IncludeArchived: true}, []string{"alpha", "beta", "delta", "gamma"}},
+		{ghstats.OwnerFilter{IncludeForks: true, IncludeArchived: true}, []string{"alpha", "beta", "delta", "fork", "gamma"}},
+	}
+
+	for _, tt := range tests {
+		results, errs, _ := run(t, client, "octo/*\nocto/beta\nghost/*\n", 3, ghstats.InputOptions{Expand: tt.filter}, ghstats.OutputOptions{})
+		if got := values(results, "name"); !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("%+v: results %v, want %v", tt.filter, got, tt.want)
+		}
+		if got := values(errs, "input"); !reflect.DeepEqual(got, []string{"ghost/*"}) {
+			t.Errorf("%+v: errors %v, want [ghost/*]", tt.filter, got)
+		}
+	}
+}
+
+func TestPipelineDiff(t *testing.T) {
+	srv := ghstatstest.NewServer(testRepos...)
+	defer srv.Close()
+	client := ghstats.NewClient(nil, srv.Endpoint(), ghstats.Options{})
+
+	dir, err := ioutil.TempDir("", "ghstats")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	// alpha is unchanged, beta has a new commit, gamma is new, and the
+	// repositories of ghost, which fails to expand, are not removed.
+	date := func(d time.Time) string { return d.Format(time.RFC3339) }
+	snapshot := `{"results": [
+		{"name": "alpha", "url": "https://github.com/octo/alpha", "lastCommit.date": "` + date(recent) + `", "lastCommit.author": ""},
+		{"name": "beta", "url": "https://github.com/octo/beta", "lastCommit.date": "` + date(old.Add(-time.Hour)) + `", "lastCommit.author": ""},
+		{"name": "gone", "url": "https://github.com/octo/gone", "lastCommit.date": "` + date(old) + `", "lastCommit.author": ""},
+		{"name": "x", "url": "https://github.com/ghost/x", "lastCommit.date": "` + date(old) + `", "lastCommit.author": ""}
+	]}`
+	path := filepath.Join(dir, "prev.json")
+	if err := ioutil.WriteFile(path, []byte(snapshot), 0600); err != nil {
+		t.Fatal(err)
+	}
+	prev, err := ghstats.LoadSnapshot(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, showUnchanged := range []bool{false, true} {
+		d := ghstats.NewDiffer(prev, "github.com")
+		results, _, r := run(t, client, "octo/alpha\nocto/beta\nocto/gamma\nghost/*\n", 3, ghstats.InputOptions{},
+			ghstats.OutputOptions{Diff: d, ShowUnchanged: showUnchanged})
+
+		want := []string{"beta:changed", "gamma:added", "gone:removed"}
+		if showUnchanged {
+			want = append([]string{"alpha:unchanged"}, want...)
+		}
+		var got []string
+		for _, record := range results {
+			got = append(got, ghstats.FormatValue(record["name"])+":"+ghstats.FormatValue(record["status"]))
+		}
+		if !reflect.DeepEqual(got, want) {
+			t.Errorf("show unchanged %t: results %v, want %v", showUnchanged, got, want)
+		}
+		if r.Summary.Statuses["removed"] != 1 {
+			t.Errorf("show unchanged %t: statuses %v, want 1 removed", showUnchanged, r.Summary.Statuses)
+		}
+	}
+}
+
+func TestPipelineStale(t *testing.T) {
+	srv := ghstatstest.NewServer(testRepos...)
+	defer srv.Close()
+	// The archived repositories are told apart with isArchived, which is
+	// queried whether it is output or not.
+	client := ghstats.NewClient(nil, srv.Endpoint(), ghstats.Options{Fields: testFields(t, "name,isArchived")})
+
+	dir, err := ioutil.TempDir("", "ghstats")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "overrides")
+	if err := ioutil.WriteFile(path, []byte("# Frozen on purpose.\nother/solo never\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		input        string
+		want         []string
+		wantExitCode int
+	}{
+		{"octo/alpha\nocto/beta\nocto/delta\nother/solo\n", []string{"alpha:fresh", "beta:stale", "delta:archived", "solo:exempt"}, 11},
+		{"octo/alpha\nother/solo\n", []string{"alpha:fresh", "solo:exempt"}, 0},
+	}
+
+	for _, tt := range tests {
+		p, err := ghstats.LoadStalePolicy(90*24*time.Hour, path, "github.com")
+		if err != nil {
+			t.Fatal(err)
+		}
+		results, _, r := run(t, client, tt.input, 3, ghstats.InputOptions{},
+			ghstats.OutputOptions{Stale: p})
+
+		var got []string
+		for _, record := range results {
+			got = append(got, ghstats.FormatValue(record["name"])+":"+ghstats.FormatValue(record["freshness"]))
+		}
+		if !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("%q: results %v, want %v", tt.input, got, tt.want)
+		}
+		if code := r.ExitCode(); code != tt.wantExitCode {
+			t.Errorf("%q: exit code %d, want %d", tt.input, code, tt.wantExitCode)
+		}
+	}
+}
+
+func TestPipelineRecordReplay(t *testing.T) {
+	srv := ghstatstest.NewServer(testRepos...)
+	dir, err := ioutil.TempDir("", "ghstats")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	// The repositories are queried one per request, so that the replay
+	// doesn't depend on the way they were batched.
+	rec, err := ghstats.NewRecorder(dir, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	input := "octo/*\nother/solo\nocto/missing\n"
+	recorded, recordedErrs, _ := run(t, ghstats.NewClient(&http.Client{Transport: rec}, srv.Endpoint(), ghstats.Options{}), input, 1, ghstats.InputOptions{}, ghstats.OutputOptions{})
+	srv.Close()
+
+	// The replay doesn't need the server.
+	replayer, err := ghstats.NewReplayer(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	client := ghstats.NewClient(&http.Client{Transport: replayer}, srv.Endpoint(), ghstats.Options{})
+	replayed, replayedErrs, _ := run(t, client, input, 1, ghstats.InputOptions{}, ghstats.OutputOptions{})
+	if !reflect.DeepEqual(replayed, recorded) || !reflect.DeepEqual(replayedErrs, recordedErrs) {
+		t.Errorf("replayed %v %v, recorded %v %v", replayed, replayedErrs, recorded, recordedErrs)
+	}
+
+	// A request which was not recorded fails.
+	results, _, r := run(t, client, "octo/beta@dev\n", 1, ghstats.InputOptions{}, ghstats.OutputOptions{})
+	if len(results) != 0 || r.Summary.Failed != 1 {
+		t.Errorf("unrecorded request: results %v, summary %+v", results, r.Summary)
+	}
+}
+
+func TestPipelineCancelled(t *testing.T) {
+	srv := ghstatstest.NewServer()
+	defer srv.Close()
+	var input bytes.Buffer
+	for i := 0; i < 100; i++ {
+		name := fmt.Sprintf("repo-%d", i)
+		srv.Add(ghstatstest.Repo{Owner: "octo", Name: name, PushedAt: recent})
+		fmt.Fprintf(&input, "octo/%s\n", name)
+	}
+	client := ghstats.NewClient(nil, srv.Endpoint(), ghstats.Options{})
+	hosts := ghstats.SingleHost(client)
+
+	// Cancel the run once the first result is out.
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	in, ie := ghstats.Input(ctx, &input, hosts, ghstats.InputOptions{})
+	out, qe := ghstats.Query(ctx, hosts, in, ghstats.QueryOptions{BatchSize: 2})
+	results := make(chan *ghstats.RepoStats)
+	go func() {
+		defer close(results)
+		for stats := range out {
+			results <- stats
+			cancel()
+		}
+	}()
+	r := <-ghstats.Output(ctx, ioutil.Discard, results, ie, qe, ghstats.OutputOptions{Sort: "input"})
+
+	// Every input read is accounted for, whatever was under way when the
+	// context was cancelled.
+	s := r.Summary
+	if s.Succeeded == 0 || s.Total != s.Succeeded+s.Failed+s.Skipped {
+		t.Errorf("summary %+v, want every input accounted for", s)
+	}
+	if s.Skipped > 0 && !ghstats.IsSkipped(r.SkipErr) {
+		t.Errorf("skip error %v, want a skipped error", r.SkipErr)
+	}
+}
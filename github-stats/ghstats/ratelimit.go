@@ -0,0 +1,160 @@
+package ghstats
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+)
+
+// RateLimit represents the rateLimit block returned along with every
+// GraphQL query.
+type RateLimit struct {
+	Limit     int       `json:"limit"`
+	Cost      int       `json:"cost"`
+	Remaining int       `json:"remaining"`
+	ResetAt   time.Time `json:"resetAt"`
+}
+
+// budgetError is returned when the rate limit budget has dropped below the
+// floor, or is exhausted, and the reset is too far away to wait for.
+type budgetError struct {
+	remaining int
+	floor     int
+	resetAt   time.Time
+}
+
+func (e *budgetError) Error() string {
+	return fmt.Sprintf("rate limit budget exhausted: %d points remaining (floor %d), resets at %s",
+		e.remaining, e.floor, e.resetAt.Local().Format(time.RFC3339))
+}
+
+// budget tracks the rate limit budget shared by all the workers of a Client.
+// Every worker consults it before issuing a query, and feeds it with the
+// rateLimit block of every response.
+type budget struct {
+	mu sync.Mutex
+
+	// floor is the number of points that should be left untouched.
+	floor int
+
+	// maxWait is the longest time to pause for a reset. If the reset is
+	// further away, the budget is reported as exhausted.
+	maxWait time.Duration
+
+	// known indicates whether or not the rate limit has been reported by
+	// the API in the current window.
+	known     bool
+	cost      int
+	remaining int
+	resetAt   time.Time
+}
+
+func newBudget(floor int, maxWait time.Duration) *budget {
+	return &budget{floor: floor, maxWait: maxWait}
+}
+
+// acquire reserves points for one query. It blocks until the budget is
+// reset if the remaining points are below the floor, or if none are left
+// whatever the floor, or returns a *budgetError if the reset is more than
+// maxWait away. It returns early if ctx is done.
+func (b *budget) acquire(ctx context.Context) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	for b.known && (b.remaining < b.floor || b.remaining <= 0) {
+		wait := time.Until(b.resetAt)
+		if wait <= 0 {
+			// A new window has started, the next response tells us
+			// where we are.
+			b.known = false
+			break
+		}
+		if wait > b.maxWait {
+			return &budgetError{b.remaining, b.floor, b.resetAt}
+		}
+
+		// Pause without holding the lock, so that the other workers
+		// end up waiting for the same reset.
+		b.mu.Unlock()
+		timer := time.NewTimer(wait)
+		select {
+		case <-timer.C:
+		case <-ctx.Done():
+			timer.Stop()
+			b.mu.Lock()
+			return ctx.Err()
+		}
+		b.mu.Lock()
+	}
+
+	if b.known {
+		// Reserve the cost of the previous query, so that concurrent
+		// workers don't overshoot the floor.
+		b.remaining -= b.cost
+	}
+	return nil
+}
+
+// update records the rate limit reported by a response.
+func (b *budget) update(rl RateLimit) {
+	if rl.ResetAt.IsZero() {
+		return
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if !b.known || rl.ResetAt.After(b.resetAt) {
+		// First report in this window.
+		b.known = true
+		b.remaining = rl.Remaining
+		b.resetAt = rl.ResetAt
+	} else if rl.Remaining < b.remaining {
+		// Responses may arrive out of order, keep the lowest one.
+		b.remaining = rl.Remaining
+	}
+	if rl.Cost > 0 {
+		b.cost = rl.Cost
+	}
+}
+
+// state returns the last rate limit reported by the API, if any.
+func (b *budget) state() (remaining int, resetAt time.Time, known bool) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.remaining, b.resetAt, b.known
+}
+
+// limiter spaces out queries so that no more than rps queries are issued
+// per second. A nil limiter never blocks.
+type limiter struct {
+	ticker *time.Ticker
+}
+
+func newLimiter(rps float64) *limiter {
+	if rps <= 0 {
+		return nil
+	}
+	return &limiter{time.NewTicker(time.Duration(float64(time.Second) / rps))}
+}
+
+// wait blocks until the next query is allowed, or until ctx is done.
+func (l *limiter) wait(ctx context.Context) error {
+	if l == nil {
+		return ctx.Err()
+	}
+	select {
+	case <-l.ticker.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+func (l *limiter) stop() {
+	if l == nil {
+		return
+	}
+	l.ticker.Stop()
+}
@@ -0,0 +1,145 @@
+package ghstats
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func TestBudgetUpdate(t *testing.T) {
+	reset := time.Now().Add(time.Hour)
+	tests := []struct {
+		name          string
+		updates       []RateLimit
+		wantRemaining int
+		wantReset     time.Time
+		wantCost      int
+		wantKnown     bool
+	}{
+		{
+			name:      "unknown",
+			updates:   []RateLimit{{Remaining: 10}},
+			wantKnown: false,
+		},
+		{
+			name:          "first report",
+			updates:       []RateLimit{{Cost: 2, Remaining: 4000, ResetAt: reset}},
+			wantRemaining: 4000,
+			wantReset:     reset,
+			wantCost:      2,
+			wantKnown:     true,
+		},
+		{
+			name:          "out of order",
+			updates:       []RateLimit{{Cost: 1, Remaining: 3990, ResetAt: reset}, {Cost: 1, Remaining: 3995, ResetAt: reset}},
+			wantRemaining: 3990,
+			wantReset:     reset,
+			wantCost:      1,
+			wantKnown:     true,
+		},
+		{
+			name:          "new window",
+			updates:       []RateLimit{{Cost: 1, Remaining: 10, ResetAt: reset}, {Cost: 3, Remaining: 5000, ResetAt: reset.Add(time.Hour)}},
+			wantRemaining: 5000,
+			wantReset:     reset.Add(time.Hour),
+			wantCost:      3,
+			wantKnown:     true,
+		},
+		{
+			name:          "cost kept",
+			updates:       []RateLimit{{Cost: 5, Remaining: 100, ResetAt: reset}, {Remaining: 90, ResetAt: reset}},
+			wantRemaining: 90,
+			wantReset:     reset,
+			wantCost:      5,
+			wantKnown:     true,
+		},
+	}
+
+	for _, tt := range tests {
+		b := newBudget(0, time.Minute)
+		for _, rl := range tt.updates {
+			b.update(rl)
+		}
+		remaining, resetAt, known := b.state()
+		if remaining != tt.wantRemaining || !resetAt.Equal(tt.wantReset) || known != tt.wantKnown || b.cost != tt.wantCost {
+			t.Errorf("%s: remaining %d, reset %s, cost %d, known %t, want %d, %s, %d, %t", tt.name,
+				remaining, resetAt, b.cost, known, tt.wantRemaining, tt.wantReset, tt.wantCost, tt.wantKnown)
+		}
+	}
+}
+
+func TestBudgetAcquire(t *testing.T) {
+	tests := []struct {
+		name      string
+		floor     int
+		maxWait   time.Duration
+		remaining int
+		resetIn   time.Duration
+
+		// wantBudget tells whether acquire returns a *budgetError, and
+		// wantWait whether it waits for the reset.
+		wantBudget bool
+		wantWait   bool
+	}{
+		{name: "above the floor", floor: 10, maxWait: time.Second, remaining: 100, resetIn: time.Hour},
+		{name: "below the floor, reset too far", floor: 10, maxWait: time.Second, remaining: 5, resetIn: time.Hour, wantBudget: true},
+		{name: "below the floor, reset soon", floor: 10, maxWait: time.Second, remaining: 5, resetIn: 50 * time.Millisecond, wantWait: true},
+		{name: "below the floor, reset passed", floor: 10, maxWait: time.Second, remaining: 5, resetIn: -time.Second},
+		{name: "exhausted without floor", floor: 0, maxWait: time.Second, remaining: 0, resetIn: time.Hour, wantBudget: true},
+		{name: "exhausted without floor, reset soon", floor: 0, maxWait: time.Second, remaining: 0, resetIn: 50 * time.Millisecond, wantWait: true},
+		{name: "last point without floor", floor: 0, maxWait: time.Second, remaining: 1, resetIn: time.Hour},
+	}
+
+	for _, tt := range tests {
+		b := newBudget(tt.floor, tt.maxWait)
+		b.update(RateLimit{Cost: 1, Remaining: tt.remaining, ResetAt: time.Now().Add(tt.resetIn)})
+
+		start := time.Now()
+		err := b.acquire(context.Background())
+		waited := time.Since(start) >= 40*time.Millisecond
+
+		if _, ok := err.(*budgetError); ok != tt.wantBudget {
+			t.Errorf("%s: acquire() = %v, want a budget error: %t", tt.name, err, tt.wantBudget)
+		}
+		if !tt.wantBudget && err != nil {
+			t.Errorf("%s: acquire() failed: %s", tt.name, err)
+		}
+		if waited != tt.wantWait {
+			t.Errorf("%s: waited %s, want a wait: %t", tt.name, time.Since(start), tt.wantWait)
+		}
+	}
+}
+
+func TestBudgetAcquireReserves(t *testing.T) {
+	b := newBudget(0, time.Minute)
+	b.update(RateLimit{Cost: 2, Remaining: 5, ResetAt: time.Now().Add(time.Hour)})
+
+	// Every query reserves the cost of the previous one, until there are
+	// no points left.
+	for i := 0; i < 3; i++ {
+		if err := b.acquire(context.Background()); err != nil {
+			t.Fatalf("acquire() #%d failed: %s", i, err)
+		}
+	}
+	if remaining, _, _ := b.state(); remaining != -1 {
+		t.Errorf("remaining %d, want -1", remaining)
+	}
+	b.maxWait = 0
+	if err := b.acquire(context.Background()); err == nil {
+		t.Error("acquire() succeeded on an exhausted budget")
+	}
+}
+
+func TestBudgetAcquireCancelled(t *testing.T) {
+	b := newBudget(10, time.Hour)
+	b.update(RateLimit{Remaining: 0, ResetAt: time.Now().Add(time.Minute)})
+
+	ctx, cancel := context.WithCancel(context.Background())
+	go func() {
+		time.Sleep(20 * time.Millisecond)
+		cancel()
+	}()
+	if err := b.acquire(ctx); err != context.Canceled {
+		t.Errorf("acquire() = %v, want %v", err, context.Canceled)
+	}
+}
@@ -0,0 +1,246 @@
+package ghstats
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+
+	"github.com/pkg/errors"
+)
+
+// recording is a request and response pair, as saved on disk.
+type recording struct {
+	Request struct {
+		Method string `json:"method"`
+		URL    string `json:"url"`
+		Body   string `json:"body"`
+	} `json:"request"`
+	Response struct {
+		Status int               `json:"status"`
+		Header map[string]string `json:"header,omitempty"`
+		Body   string            `json:"body"`
+	} `json:"response"`
+}
+
+// recordedHeaders are the response headers which are recorded, the ones
+// the client reads.
+var recordedHeaders = []string{"Content-Type", "Retry-After", "X-RateLimit-Remaining", "X-RateLimit-Reset"}
+
+// redacted replaces the access tokens in the recordings.
+const redacted = "REDACTED"
+
+// minScrubLength is the length of the shortest token scrubbed from the
+// recordings. Github tokens are much longer, while scrubbing a shorter
+// string would corrupt unrelated content.
+const minScrubLength = 16
+
+// recordingKey returns the key of the recordings of a request, the hash of
+// its method, URL and body.
+func recordingKey(method, url string, body []byte) string {
+	h := sha256.New()
+	h.Write([]byte(method + " " + url))
+	h.Write([]byte{0})
+	h.Write(body)
+	return hex.EncodeToString(h.Sum(nil))[:32]
+}
+
+// recordingName returns the file name of the n-th recording of a key, n
+// starting at 0. The same request is recorded as many times as it is sent,
+// e.g. when it is retried.
+func recordingName(key string, n int) string {
+	return fmt.Sprintf("%s-%d.json", key, n)
+}
+
+// counter counts the requests sent, by key.
+type counter struct {
+	mu     sync.Mutex
+	counts map[string]int
+}
+
+// next returns the number of the requests of a key sent so far, and counts
+// one more.
+func (c *counter) next(key string) int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	n := c.counts[key]
+	c.counts[key]++
+	return n
+}
+
+// Recorder is an http.RoundTripper which saves every request and response
+// pair in a directory, to be served by a Replayer later on. The request
+// headers are not recorded, and the access token of the Authorization
+// header is scrubbed from the bodies, unless it is too short to be told
+// apart from their content. It should be put under the
+// authentication, e.g. as the Base of an oauth2.Transport.
+type Recorder struct {
+	dir   string
+	base  http.RoundTripper
+	count counter
+}
+
+// NewRecorder returns a Recorder saving the requests sent with base, or
+// http.DefaultTransport if nil, in dir. The recordings of the same requests
+// are replaced, so dir is better empty.
+func NewRecorder(dir string, base http.RoundTripper) (*Recorder, error) {
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, errors.Wrap(err, "create record directory failed")
+	}
+	if base == nil {
+		base = http.DefaultTransport
+	}
+	return &Recorder{dir: dir, base: base, count: counter{counts: make(map[string]int)}}, nil
+}
+
+// RoundTrip sends the request with the base transport, and saves the pair
+// once the response is read. A failure to save it fails the request, so
+// that no recording is missed silently.
+func (r *Recorder) RoundTrip(req *http.Request) (*http.Response, error) {
+	body, err := readBody(req)
+	if err != nil {
+		return nil, err
+	}
+
+	resp, err := r.base.RoundTrip(req)
+	if err != nil {
+		return nil, err
+	}
+	respBody, err := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	if err != nil {
+		return nil, err
+	}
+	resp.Body = ioutil.NopCloser(bytes.NewReader(respBody))
+
+	// The token is the last word of the Authorization header, whatever
+	// the scheme. The request headers are not recorded, but the token may
+	// be echoed in the bodies.
+	scrub := func(s string) string { return s }
+	if auth := strings.Fields(req.Header.Get("Authorization")); len(auth) > 0 && len(auth[len(auth)-1]) >= minScrubLength {
+		scrub = strings.NewReplacer(auth[len(auth)-1], redacted).Replace
+	}
+
+	var rec recording
+	rec.Request.Method = req.Method
+	rec.Request.URL = scrub(req.URL.String())
+	rec.Request.Body = scrub(string(body))
+	rec.Response.Status = resp.StatusCode
+	rec.Response.Body = scrub(string(respBody))
+	for _, name := range recordedHeaders {
+		if v := resp.Header.Get(name); v != "" {
+			if rec.Response.Header == nil {
+				rec.Response.Header = make(map[string]string)
+			}
+			rec.Response.Header[name] = v
+		}
+	}
+
+	// The recording is keyed by the request as it is sent, so that the
+	// replayer finds it whatever the token.
+	key := recordingKey(req.Method, req.URL.String(), body)
+	b, err := json.MarshalIndent(&rec, "", "  ")
+	if err == nil {
+		err = ioutil.WriteFile(filepath.Join(r.dir, recordingName(key, r.count.next(key))), b, 0600)
+	}
+	if err != nil {
+		return nil, WithClass(errors.Wrap(err, "record response failed"), ClassUnknown)
+	}
+	return resp, nil
+}
+
+// Replayer is an http.RoundTripper which serves the responses saved by a
+// Recorder, without sending the requests. When the same request was
+// recorded several times, the responses are served in the recorded order,
+// the last one being repeated. A request which was not recorded fails.
+// The requests are matched by their body, so a batch is only replayed if
+// it holds the same repositories as when it was recorded: querying one
+// repository per request keeps a replay independent of the timing.
+type Replayer struct {
+	dir   string
+	count counter
+
+	// recorded holds the number of recordings of every key.
+	recorded map[string]int
+}
+
+// NewReplayer returns a Replayer of the recordings in dir.
+func NewReplayer(dir string) (*Replayer, error) {
+	files, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return nil, errors.Wrap(err, "read replay directory failed")
+	}
+	recorded := make(map[string]int)
+	for _, fi := range files {
+		var key string
+		var n int
+		if _, err := fmt.Sscanf(strings.Replace(fi.Name(), "-", " ", 1), "%s %d.json", &key, &n); err == nil && n >= recorded[key] {
+			recorded[key] = n + 1
+		}
+	}
+	return &Replayer{dir: dir, count: counter{counts: make(map[string]int)}, recorded: recorded}, nil
+}
+
+// RoundTrip serves the recorded response to the request.
+func (r *Replayer) RoundTrip(req *http.Request) (*http.Response, error) {
+	body, err := readBody(req)
+	if err != nil {
+		return nil, err
+	}
+
+	key := recordingKey(req.Method, req.URL.String(), body)
+	n := r.count.next(key)
+	if r.recorded[key] == 0 {
+		return nil, WithClass(errors.Errorf("no recording of the request in %s", r.dir), ClassUnknown)
+	}
+	if n >= r.recorded[key] {
+		n = r.recorded[key] - 1
+	}
+
+	b, err := ioutil.ReadFile(filepath.Join(r.dir, recordingName(key, n)))
+	if err != nil {
+		return nil, WithClass(errors.Wrap(err, "read recording failed"), ClassUnknown)
+	}
+	var rec recording
+	if err := json.Unmarshal(b, &rec); err != nil {
+		return nil, WithClass(errors.Wrap(err, "decode recording failed"), ClassUnknown)
+	}
+
+	header := make(http.Header)
+	for name, v := range rec.Response.Header {
+		header.Set(name, v)
+	}
+	return &http.Response{
+		Status:        fmt.Sprintf("%d %s", rec.Response.Status, http.StatusText(rec.Response.Status)),
+		StatusCode:    rec.Response.Status,
+		Proto:         "HTTP/1.1",
+		ProtoMajor:    1,
+		ProtoMinor:    1,
+		Header:        header,
+		Body:          ioutil.NopCloser(strings.NewReader(rec.Response.Body)),
+		ContentLength: int64(len(rec.Response.Body)),
+		Request:       req,
+	}, nil
+}
+
+// readBody reads the body of a request, and rewinds it so that the request
+// can still be sent.
+func readBody(req *http.Request) ([]byte, error) {
+	if req.Body == nil {
+		return nil, nil
+	}
+	body, err := ioutil.ReadAll(req.Body)
+	req.Body.Close()
+	if err != nil {
+		return nil, errors.Wrap(err, "read request failed")
+	}
+	req.Body = ioutil.NopCloser(bytes.NewReader(body))
+	return body, nil
+}
@@ -0,0 +1,205 @@
+package ghstats
+
+import (
+	"strconv"
+	"strings"
+)
+
+// latestReleases are the latest created releases. Drafts come first when
+// the token has push access to the repository, so a few releases are
+// queried to skip them.
+const latestReleases = "latestReleases: releases(first: 10, orderBy: {field: CREATED_AT, direction: DESC})"
+
+// latestTags are the tags of the latest commits, among which the latest
+// semver tag is looked for.
+const latestTags = `latestTags: refs(refPrefix: "refs/tags/", first: 20, orderBy: {field: TAG_COMMIT_DATE, direction: DESC})`
+
+// releaseField returns a field of the latest release which is not a draft,
+// computed from the values leaf leads to by value.
+func releaseField(name, header string, leaf []string, value func(values []interface{}) interface{}) *Field {
+	return &Field{
+		name:   name,
+		header: header,
+		path:   []string{latestReleases, "nodes"},
+		leaves: [][]string{{"isDraft"}, leaf},
+		derive: func(releases []interface{}) interface{} {
+			for _, v := range releases {
+				release, _ := v.(map[string]interface{})
+				if draft, _ := release["isDraft"].(bool); release != nil && !draft {
+					return value(walk(release, leaf))
+				}
+			}
+			return nil
+		},
+	}
+}
+
+// first returns the first value, or nil if there are none.
+func first(values []interface{}) interface{} {
+	if len(values) == 0 {
+		return nil
+	}
+	return values[0]
+}
+
+// sum returns the sum of the numbers.
+func sum(values []interface{}) interface{} {
+	total := 0.0
+	for _, v := range values {
+		n, _ := v.(float64)
+		total += n
+	}
+	return total
+}
+
+// tagCommitsPaths are the selection paths of the number of commits of the
+// tags, whether they are lightweight, pointing to a commit, or annotated,
+// pointing to a tag object.
+var tagCommitsPaths = [][]string{
+	{"target", "... on Commit", "history", "totalCount"},
+	{"target", "... on Tag", "target", "... on Commit", "history", "totalCount"},
+}
+
+// defaultBranchCommitsPath is the selection path of the number of commits
+// of the default branch, whichever branch is queried.
+var defaultBranchCommitsPath = []string{"defaultBranchRef", "target", "... on Commit", "history", "totalCount"}
+
+// commitsSinceLeaves are the selection paths, relative to the repository,
+// which the number of commits since the latest semver tag is computed from.
+var commitsSinceLeaves = func() [][]string {
+	leaves := [][]string{{latestTags, "nodes", "name"}, defaultBranchCommitsPath}
+	for _, path := range tagCommitsPaths {
+		leaves = append(leaves, append([]string{latestTags, "nodes"}, path...))
+	}
+	return leaves
+}()
+
+// latestTagName returns the name of the latest semver tag.
+func latestTagName(tags []interface{}) interface{} {
+	if tag := latestTag(tags); tag != nil {
+		return tag["name"]
+	}
+	return nil
+}
+
+// commitsSinceTag returns the number of commits of the default branch since
+// the latest semver tag, as the difference between the numbers of commits
+// of their histories. It is exact if the tag is in the history of the
+// default branch, and approximate otherwise, e.g. if the tag is on a
+// maintenance branch. It is nil if the tag has more commits than the
+// default branch, or if there is no semver tag.
+func commitsSinceTag(repos []interface{}) interface{} {
+	if len(repos) == 0 {
+		return nil
+	}
+	tag := latestTag(walk(repos[0], []string{latestTags, "nodes"}))
+	if tag == nil {
+		return nil
+	}
+	var tagCommits []interface{}
+	for _, path := range tagCommitsPaths {
+		tagCommits = append(tagCommits, walk(tag, path)...)
+	}
+	since, ok := first(tagCommits).(float64)
+	if !ok {
+		return nil
+	}
+	total, ok := first(walk(repos[0], defaultBranchCommitsPath)).(float64)
+	if !ok || total < since {
+		return nil
+	}
+	return total - since
+}
+
+// latestTag returns the tag with the highest semver precedence, or nil if
+// none of the tags is a semver.
+func latestTag(tags []interface{}) map[string]interface{} {
+	var latest map[string]interface{}
+	var latestVersion *semver
+	for _, v := range tags {
+		tag, _ := v.(map[string]interface{})
+		name, _ := tag["name"].(string)
+		version := parseSemver(name)
+		if version != nil && (latestVersion == nil || latestVersion.less(version)) {
+			latest, latestVersion = tag, version
+		}
+	}
+	return latest
+}
+
+// semver is a semantic version, see https://semver.org. The build metadata
+// is ignored, as it does not count in the precedence.
+type semver struct {
+	major, minor, patch int
+	prerelease          []string
+}
+
+// parseSemver parses a semantic version, with an optional "v" prefix as in
+// most tags. It returns nil if the name is not a semantic version.
+func parseSemver(name string) *semver {
+	if strings.HasPrefix(name, "v") || strings.HasPrefix(name, "V") {
+		name = name[1:]
+	}
+	if i := strings.Index(name, "+"); i >= 0 {
+		name = name[:i]
+	}
+	v := &semver{}
+	if i := strings.Index(name, "-"); i >= 0 {
+		v.prerelease = strings.Split(name[i+1:], ".")
+		name = name[:i]
+		for _, id := range v.prerelease {
+			if id == "" {
+				return nil
+			}
+		}
+	}
+
+	parts := strings.Split(name, ".")
+	if len(parts) != 3 {
+		return nil
+	}
+	numbers := []*int{&v.major, &v.minor, &v.patch}
+	for i, part := range parts {
+		n, err := strconv.Atoi(part)
+		if err != nil || n < 0 || strings.HasPrefix(part, "+") {
+			return nil
+		}
+		*numbers[i] = n
+	}
+	return v
+}
+
+// less reports whether v has a lower precedence than w.
+func (v *semver) less(w *semver) bool {
+	if v.major != w.major {
+		return v.major < w.major
+	}
+	if v.minor != w.minor {
+		return v.minor < w.minor
+	}
+	if v.patch != w.patch {
+		return v.patch < w.patch
+	}
+
+	// A pre-release version has a lower precedence than the release.
+	if len(v.prerelease) == 0 || len(w.prerelease) == 0 {
+		return len(v.prerelease) > len(w.prerelease)
+	}
+	for i := 0; i < len(v.prerelease) && i < len(w.prerelease); i++ {
+		a, b := v.prerelease[i], w.prerelease[i]
+		if a == b {
+			continue
+		}
+		m, errA := strconv.Atoi(a)
+		n, errB := strconv.Atoi(b)
+		switch {
+		case errA == nil && errB == nil:
+			return m < n
+		case errA == nil || errB == nil:
+			// Numeric identifiers have a lower precedence.
+			return errA == nil
+		}
+		return a < b
+	}
+	return len(v.prerelease) < len(w.prerelease)
+}
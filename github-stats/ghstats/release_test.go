@@ -0,0 +1,79 @@
+package ghstats
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestParseSemver(t *testing.T) {
+	tests := []struct {
+		name string
+		want *semver
+	}{
+		{"1.2.3", &semver{major: 1, minor: 2, patch: 3}},
+		{"v1.2.3", &semver{major: 1, minor: 2, patch: 3}},
+		{"V10.20.30", &semver{major: 10, minor: 20, patch: 30}},
+		{"v1.2.3-rc.1", &semver{major: 1, minor: 2, patch: 3, prerelease: []string{"rc", "1"}}},
+		{"1.2.3+build.5", &semver{major: 1, minor: 2, patch: 3}},
+		{"1.2.3-beta+build.5", &semver{major: 1, minor: 2, patch: 3, prerelease: []string{"beta"}}},
+		{"1.2", nil},
+		{"1.2.3.4", nil},
+		{"v1.x.3", nil},
+		{"1.2.+3", nil},
+		{"1.2.3-", nil},
+		{"1.2.3-rc..1", nil},
+		{"nightly", nil},
+		{"release-1.2.3", nil},
+		{"", nil},
+	}
+
+	for _, tt := range tests {
+		if got := parseSemver(tt.name); !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("parseSemver(%q) = %+v, want %+v", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestSemverLess(t *testing.T) {
+	// Each version has a lower precedence than the next one, as in the
+	// example of https://semver.org.
+	versions := []string{
+		"0.9.9",
+		"1.0.0-alpha",
+		"1.0.0-alpha.1",
+		"1.0.0-alpha.beta",
+		"1.0.0-beta",
+		"1.0.0-beta.2",
+		"1.0.0-beta.11",
+		"1.0.0-rc.1",
+		"1.0.0",
+		"1.0.1",
+		"1.1.0",
+		"1.10.0",
+		"2.0.0",
+	}
+
+	for i, a := range versions {
+		for j, b := range versions {
+			v, w := parseSemver(a), parseSemver(b)
+			if got, want := v.less(w), i < j; got != want {
+				t.Errorf("%s.less(%s) = %t, want %t", a, b, got, want)
+			}
+		}
+	}
+}
+
+func TestLatestTag(t *testing.T) {
+	tags := []interface{}{
+		map[string]interface{}{"name": "nightly"},
+		map[string]interface{}{"name": "v1.10.0"},
+		map[string]interface{}{"name": "v2.0.0-rc.1"},
+		map[string]interface{}{"name": "v1.9.0"},
+	}
+	if got := latestTagName(tags); got != "v2.0.0-rc.1" {
+		t.Errorf("latestTagName() = %v, want v2.0.0-rc.1", got)
+	}
+	if got := latestTagName(tags[:1]); got != nil {
+		t.Errorf("latestTagName() = %v, want nil without semver tags", got)
+	}
+}
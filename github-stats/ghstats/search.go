@@ -0,0 +1,89 @@
+package ghstats
+
+import (
+	"context"
+	"encoding/json"
+
+	"github.com/pkg/errors"
+)
+
+// searchQuery lists one page of the repositories matching a search query.
+const searchQuery = `query($query: String!, $first: Int!, $after: String) {
+	search(query: $query, type: REPOSITORY, first: $first, after: $after) {
+		pageInfo {
+			hasNextPage
+			endCursor
+		}
+		nodes {
+			... on Repository {
+				nameWithOwner
+			}
+		}
+	}
+	rateLimit {
+		limit
+		cost
+		remaining
+		resetAt
+	}
+}`
+
+// searchResult receives the search field of searchQuery.
+type searchResult struct {
+	PageInfo struct {
+		HasNextPage bool   `json:"hasNextPage"`
+		EndCursor   string `json:"endCursor"`
+	} `json:"pageInfo"`
+	Nodes []struct {
+		NameWithOwner string `json:"nameWithOwner"`
+	} `json:"nodes"`
+}
+
+// SearchRepositories pages through the repositories matching a search
+// query, using the same syntax as the search on github.com, and calls fn with
+// $orgname/$repo of each of them. At most limit repositories are returned,
+// 0 means no limit. Note that Github never returns more than 1000 results.
+func (client *Client) SearchRepositories(ctx context.Context, query string, limit int, fn func(nameWithOwner string)) error {
+	variables := map[string]interface{}{
+		"query": query,
+	}
+
+	n := 0
+	for limit <= 0 || n < limit {
+		first := 100
+		if limit > 0 && limit-n < first {
+			first = limit - n
+		}
+		variables["first"] = first
+
+		out, err := client.post(ctx, searchQuery, variables)
+		if err != nil {
+			return err
+		}
+		if len(out.Errors) > 0 {
+			return classifyGraphQLErrors(out.Errors)
+		}
+
+		var result searchResult
+		if raw := out.Data["search"]; len(raw) > 0 {
+			if err := json.Unmarshal(raw, &result); err != nil {
+				return errors.Wrap(err, "json decode failed")
+			}
+		}
+
+		for _, node := range result.Nodes {
+			// Nodes of other types are empty.
+			if node.NameWithOwner == "" {
+				continue
+			}
+			fn(node.NameWithOwner)
+			n++
+		}
+
+		if !result.PageInfo.HasNextPage {
+			break
+		}
+		variables["after"] = result.PageInfo.EndCursor
+	}
+	return nil
+}
@@ -0,0 +1,131 @@
+package ghstats
+
+import (
+	"bufio"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// exitStale is the exit code of a run which found stale or archived
+// repositories, and had no failures.
+const exitStale = 11
+
+// freshnesses lists the freshness of the repositories with -stale-after.
+var freshnesses = []string{"fresh", "stale", "archived", "exempt"}
+
+// freshnessField is the column holding the freshness of the repositories.
+// It is not queried, so it is not part of fieldRegistry.
+var freshnessField = &Field{name: "freshness", header: "Freshness"}
+
+// ParseAge parses a duration which may also be given in days or weeks, e.g.
+// 180d or 26w, besides the units of time.ParseDuration.
+func ParseAge(s string) (time.Duration, error) {
+	for suffix, unit := range map[string]time.Duration{"d": 24 * time.Hour, "w": 7 * 24 * time.Hour} {
+		if n := strings.TrimSuffix(s, suffix); n != s {
+			v, err := strconv.ParseFloat(n, 64)
+			if err != nil {
+				return 0, errors.Errorf("invalid age %q", s)
+			}
+			return time.Duration(v * float64(unit)), nil
+		}
+	}
+	d, err := time.ParseDuration(s)
+	if err != nil {
+		return 0, errors.Errorf("invalid age %q", s)
+	}
+	return d, nil
+}
+
+// StalePolicy tells whether repositories are stale, i.e. whether their
+// latest commit is older than the maximum age.
+type StalePolicy struct {
+	maxAge time.Duration
+
+	// overrides holds the maximum age of some repositories, or of all the
+	// repositories of an owner, keyed by [$host/]$orgname/$repo or
+	// [$host/]$orgname/* in lower case, see repoKey. 0 means the
+	// repositories are never stale.
+	overrides map[string]time.Duration
+
+	now time.Time
+}
+
+// LoadStalePolicy returns the policy with the given maximum age, and the
+// overrides read from path if it is set. Each line of the file holds a
+// repository, or $orgname/* for all the repositories of an owner, followed
+// by its maximum age, or "never". Blank lines and lines starting with #
+// are ignored. defaultHost is the host of the repositories which don't name
+// one, e.g. github.com.
+func LoadStalePolicy(maxAge time.Duration, path, defaultHost string) (*StalePolicy, error) {
+	p := &StalePolicy{maxAge: maxAge, overrides: make(map[string]time.Duration), now: time.Now()}
+	if path == "" {
+		return p, nil
+	}
+
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, errors.Wrap(err, "read stale overrides failed")
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	for n := 1; scanner.Scan(); n++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		fields := strings.Fields(line)
+		if len(fields) != 2 {
+			return nil, errors.Errorf("%s:%d: should be in format of $orgname/$repo $age", path, n)
+		}
+		ref, err := ParseRepoRef(fields[0], "")
+		if err != nil {
+			return nil, errors.Wrapf(err, "%s:%d", path, n)
+		}
+
+		var age time.Duration
+		if fields[1] != "never" {
+			if age, err = ParseAge(fields[1]); err != nil || age <= 0 {
+				return nil, errors.Errorf("%s:%d: invalid age %q, should be like 180d or never", path, n, fields[1])
+			}
+		}
+		p.overrides[repoKey(ref, defaultHost)] = age
+	}
+	return p, scanner.Err()
+}
+
+// freshness returns the freshness of a result, which is exempt if the
+// repository is never stale as per the overrides, archived if it is
+// archived, stale if its latest commit is older than its maximum age, and
+// fresh otherwise.
+func (p *StalePolicy) freshness(stats *RepoStats) string {
+	key := URLKey(stats.URL)
+	maxAge, ok := p.overrides[key]
+	if !ok {
+		if i := strings.LastIndex(key, "/"); i >= 0 {
+			maxAge, ok = p.overrides[key[:i]+"/*"]
+		}
+	}
+	if ok && maxAge == 0 {
+		return "exempt"
+	}
+	if !ok {
+		maxAge = p.maxAge
+	}
+
+	if archived, _ := stats.Values["isArchived"].(bool); archived {
+		return "archived"
+	}
+
+	// Commits without a valid date are considered stale, as their age
+	// can not be told.
+	if maxAge > 0 && (stats.CommitTime.IsZero() || p.now.Sub(stats.CommitTime) > maxAge) {
+		return "stale"
+	}
+	return "fresh"
+}
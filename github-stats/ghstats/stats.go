@@ -0,0 +1,706 @@
+package ghstats
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"text/template"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// GithubEndpoint is the GraphQL endpoint of github.com.
+const GithubEndpoint = "https://api.github.com/graphql"
+
+const contentType = "application/json"
+
+// Querier queries the Github GraphQL API. It is implemented by Client, and
+// may be implemented by fakes in tests.
+type Querier interface {
+	// QueryBatch queries the stats of a batch of repositories.
+	QueryBatch(ctx context.Context, refs []RepoRef) ([]*RepoStats, []error)
+
+	// ListRepositories calls fn with the name of every repository of an
+	// owner which matches the filter.
+	ListRepositories(ctx context.Context, owner string, filter OwnerFilter, fn func(name string)) error
+
+	// SearchRepositories calls fn with the full name of every repository
+	// matching the search query, up to limit.
+	SearchRepositories(ctx context.Context, query string, limit int, fn func(nameWithOwner string)) error
+}
+
+// Client manages communications with the Github GraphQL API.
+type Client struct {
+	httpClient    *http.Client
+	endpoint      string
+	queryTemplate *template.Template
+	budget        *budget
+
+	// pool holds the tokens the queries are sent with, if any. Each of
+	// them has its own budget, instead of budget.
+	pool *tokenPool
+
+	// timeout is the timeout of each request, 0 means no timeout.
+	timeout time.Duration
+
+	// retries is the maximum number of retries of a failed request.
+	retries int
+
+	// cache stores the responses, it is nil if caching is disabled, and
+	// credential identifies the credentials of httpClient in its keys.
+	cache      *Cache
+	credential string
+
+	// observe is called with the latency of every request, if set.
+	observe func(d time.Duration)
+
+	// fields are the queried fields, and repoFields and refFields are the
+	// selection sets generated from them.
+	fields     []*Field
+	repoFields string
+	refFields  string
+
+	// sample is the number of nodes the sampled connections are paged
+	// through to, and pagers page through them.
+	sample int
+	pagers []*connectionPager
+}
+
+// RepoRef identifies a repository by its owner & name pair, and optionally
+// the Github host it lives on and the branch to fetch the commit history
+// from.
+type RepoRef struct {
+	// Host is the Github host, e.g. a Github Enterprise Server. The empty
+	// host stands for the default endpoint.
+	Host string
+
+	Owner  string
+	Name   string
+	Branch string
+
+	// seq is the sequence number of the input, if sequenced is set, i.e.
+	// if it comes from Input. Query numbers the others.
+	seq       int
+	sequenced bool
+}
+
+// ParseRepoRef parses a string in the format of
+// [$host/]$orgname/$repo[@$branch]. If the branch is omitted, defaultBranch
+// is used. The repository may be a "*" wildcard, which stands for all the
+// repositories of the owner.
+func ParseRepoRef(s, defaultBranch string) (RepoRef, error) {
+	invalid := errors.New("invalid input: should be in format of [$host/]$orgname/$repo[@$branch]")
+
+	branch := defaultBranch
+	if i := strings.LastIndex(s, "@"); i >= 0 {
+		s, branch = s[:i], s[i+1:]
+		if branch == "" {
+			return RepoRef{}, invalid
+		}
+	}
+
+	var host string
+	fields := strings.Split(s, "/")
+	if len(fields) == 3 {
+		host, fields = strings.ToLower(fields[0]), fields[1:]
+		if host == "" {
+			return RepoRef{}, invalid
+		}
+	}
+	if len(fields) != 2 || fields[0] == "" || fields[1] == "" {
+		return RepoRef{}, invalid
+	}
+	return RepoRef{Host: host, Owner: fields[0], Name: fields[1], Branch: branch}, nil
+}
+
+func (ref RepoRef) String() string {
+	s := ref.Owner + "/" + ref.Name
+	if ref.Host != "" {
+		s = ref.Host + "/" + s
+	}
+	if ref.Branch != "" {
+		s += "@" + ref.Branch
+	}
+	return s
+}
+
+// IsWildcard reports whether ref stands for all the repositories of the
+// owner.
+func (ref RepoRef) IsWildcard() bool {
+	return ref.Name == "*"
+}
+
+// QualifiedBranch returns the fully qualified name of the branch, or an empty
+// string if no branch is specified.
+func (ref RepoRef) QualifiedBranch() string {
+	if ref.Branch == "" || strings.HasPrefix(ref.Branch, "refs/") {
+		return ref.Branch
+	}
+	return "refs/heads/" + ref.Branch
+}
+
+// branchNotFoundError is returned when the branch specified for a repository
+// does not exist.
+type branchNotFoundError struct {
+	branch string
+}
+
+func (e *branchNotFoundError) Error() string {
+	return fmt.Sprintf("query error: branch not found: %s", e.branch)
+}
+
+// RepoStats represents the repository information that we are interested in.
+type RepoStats struct {
+	Name       string `json:"name"`
+	URL        string `json:"url"`
+	Branch     string `json:"branch"`
+	CommitDate string `json:"commitDate"`
+	AuthorName string `json:"authorName"`
+
+	// CommitTime is CommitDate parsed, it is zero if the date is
+	// malformed.
+	CommitTime time.Time `json:"-"`
+
+	// Values holds the values of all the queried fields, keyed by the
+	// field names. Null values are omitted.
+	Values map[string]interface{} `json:"-"`
+
+	// seq is the sequence number of the input.
+	seq int
+
+	// input is the input the stats were queried for.
+	input string
+
+	// cached indicates whether the stats were read from the cache.
+	cached bool
+
+	// warnings holds the errors of the fields which failed to resolve,
+	// which are missing from Values.
+	warnings []error
+}
+
+// CsvRecords converts the RepoStats object to a valid csv record, which is
+// actually a string array.
+func (stats *RepoStats) CsvRecord(fields []*Field) []string {
+	record := make([]string, len(fields))
+	for i, f := range fields {
+		record[i] = FormatValue(stats.Values[f.name])
+	}
+	return record
+}
+
+// CsvHeader returns a string array which represents the header record of a
+// list of csv records.
+func CsvHeader(fields []*Field) []string {
+	header := make([]string, len(fields))
+	for i, f := range fields {
+		header[i] = f.header
+	}
+	return header
+}
+
+// Options configures a Client. The zero value queries the default fields,
+// with no rate limit floor, no timeout, no retries and no cache.
+type Options struct {
+	// Fields are the fields to query, DefaultFields if empty. The core
+	// fields are always queried besides them.
+	Fields []*Field
+
+	// RateFloor is the number of rate limit points to leave untouched,
+	// and MaxWait is the longest time to pause for a rate limit reset
+	// once below the floor. The queries pause once no points are left,
+	// even with a zero floor.
+	RateFloor int
+	MaxWait   time.Duration
+
+	// Timeout is the timeout of each request, 0 means no timeout.
+	Timeout time.Duration
+
+	// Retries is the maximum number of retries of a request which failed
+	// with a transient error.
+	Retries int
+
+	// Cache stores the responses, nil disables caching. Credential
+	// identifies the credentials httpClient authenticates the requests
+	// with, e.g. the access token, so that the cached responses are only
+	// served to the same credentials. With Tokens, the responses are
+	// keyed by the token of each query instead.
+	Cache      *Cache
+	Credential string
+
+	// Observe is called with the latency of every request sent, if set.
+	Observe func(d time.Duration)
+
+	// Sample is the number of the latest closed pull requests the health
+	// fields, e.g. prs.medianMergeHours, are computed from. It defaults
+	// to DefaultSample. More than 100 takes a request per page of 100.
+	Sample int
+
+	// Tokens, if set, are the access tokens to spread the queries over,
+	// each with its own rate limit budget. Every query is sent with the
+	// token with the most points left, and is sent again with another one
+	// if the token is revoked or exhausted. httpClient should not
+	// authenticate the requests then.
+	Tokens []string
+}
+
+// NewClient returns a new Github GraphQL API client, which sends the queries
+// to endpoint with httpClient. The endpoint defaults to GithubEndpoint, and
+// httpClient to http.DefaultClient. httpClient is responsible for the
+// authentication, e.g. with oauth2.NewClient.
+func NewClient(httpClient *http.Client, endpoint string, opts Options) *Client {
+	if httpClient == nil {
+		httpClient = http.DefaultClient
+	}
+	if endpoint == "" {
+		endpoint = GithubEndpoint
+	}
+
+	tmpl, _ := template.New("query").Parse(queryTemplate)
+
+	selected := opts.Fields
+	if len(selected) == 0 {
+		selected = DefaultFields()
+	}
+	fields := queriedFields(selected)
+	sample := opts.Sample
+	if sample <= 0 {
+		sample = DefaultSample
+	}
+	pageSize := sample
+	if pageSize > maxPageSize {
+		pageSize = maxPageSize
+	}
+	repoFields, refFields := selectionSets(fields, pageSize)
+
+	return &Client{
+		httpClient:    httpClient,
+		endpoint:      endpoint,
+		queryTemplate: tmpl,
+		budget:        newBudget(opts.RateFloor, opts.MaxWait),
+		pool:          newTokenPool(opts.Tokens, opts.RateFloor, opts.MaxWait),
+		timeout:       opts.Timeout,
+		retries:       opts.Retries,
+		cache:         opts.Cache,
+		credential:    opts.Credential,
+		observe:       opts.Observe,
+		fields:        fields,
+		repoFields:    repoFields,
+		refFields:     refFields,
+		sample:        sample,
+		pagers:        connectionPagers(fields, pageSize),
+	}
+}
+
+// Endpoint returns the GraphQL endpoint of the client.
+func (client *Client) Endpoint() string {
+	return client.endpoint
+}
+
+// RateLimit returns the rate limit budget left, as reported by the latest
+// response. known is false until a response reported it. With Tokens, it
+// is the sum of the budgets of the tokens which are not revoked.
+func (client *Client) RateLimit() (remaining int, resetAt time.Time, known bool) {
+	if client.pool != nil {
+		return client.pool.rateLimit()
+	}
+	return client.budget.state()
+}
+
+// TokenUsage reports the use of every token of Tokens so far, in order. It
+// returns nil if Tokens is not set.
+func (client *Client) TokenUsage() []TokenUsage {
+	if client.pool == nil {
+		return nil
+	}
+	return client.pool.usage()
+}
+
+// queryTemplate renders one aliased repository field per RepoRef, so that a
+// batch of repositories is queried with a single request. The aliases are
+// r0, r1, ..., in the same order as the RepoRefs. The branch of each
+// repository is aliased as branchRef, which is the default branch unless
+// another one is specified. The selection sets of the fragments are
+// generated from the queried fields.
+const queryTemplate = `query{
+{{- range $i, $ref := .Refs }}
+	r{{ $i }}: repository(owner: {{ printf "%q" $ref.Owner }}, name: {{ printf "%q" $ref.Name }}) {
+		...repoFields
+		{{- if $ref.Branch }}
+		branchRef: ref(qualifiedName: {{ printf "%q" $ref.QualifiedBranch }}) {
+		{{- else }}
+		branchRef: defaultBranchRef {
+		{{- end }}
+			...refFields
+		}
+	}
+{{- end }}
+	rateLimit {
+		limit
+		cost
+		remaining
+		resetAt
+	}
+}
+
+fragment repoFields on Repository {
+{{ .RepoFields -}}
+}
+
+fragment refFields on Ref {
+{{ .RefFields -}}
+}`
+
+// QueryResult receives the result returns from Github GraphQL API after
+// a GraphQL query is issued. Data is keyed by the aliases used in the
+// query, plus the rateLimit field.
+type QueryResult struct {
+	Data   map[string]json.RawMessage `json:"data"`
+	Errors []graphQLError             `json:"errors"`
+
+	// cached indicates whether the result was read from the cache.
+	cached bool
+}
+
+// graphQLError is an error of a GraphQL response. The path leads to the
+// field which failed to resolve, if any.
+type graphQLError struct {
+	Type      string
+	Message   string
+	Locations []struct {
+		Line   int
+		Column int
+	}
+	Path []interface{}
+}
+
+// String returns the message of the error along with its type, and its path,
+// or its location in the query if it has no path, e.g.
+// "FORBIDDEN at repository.licenseInfo: Resource not accessible".
+func (e graphQLError) String() string {
+	var where string
+	for _, p := range e.Path {
+		if i, ok := p.(float64); ok {
+			where += fmt.Sprintf("[%d]", int(i))
+		} else if where == "" {
+			where = fmt.Sprint(p)
+		} else {
+			where += "." + fmt.Sprint(p)
+		}
+	}
+	if where == "" && len(e.Locations) > 0 {
+		where = fmt.Sprintf("line %d, column %d", e.Locations[0].Line, e.Locations[0].Column)
+	}
+
+	switch {
+	case where == "" && e.Type == "":
+		return e.Message
+	case where == "":
+		return e.Type + ": " + e.Message
+	case e.Type == "":
+		return "at " + where + ": " + e.Message
+	}
+	return e.Type + " at " + where + ": " + e.Message
+}
+
+// Query queries repository information for the given owner & name pair. The
+// commit history is fetched from the given branch, or from the default
+// branch if it is empty.
+func (client *Client) Query(ctx context.Context, owner, name, branch string) (*RepoStats, error) {
+	stats, errs := client.QueryBatch(ctx, []RepoRef{{Owner: owner, Name: name, Branch: branch}})
+	return stats[0], errs[0]
+}
+
+// QueryBatch queries repository information for a batch of repositories
+// with a single request. The returned slices have the same length as refs:
+// for each repository, either the stats or the error is set. An error of
+// one repository doesn't affect the others in the batch. If some fields of
+// a repository failed to resolve, the stats hold the other ones, and the
+// errors as warnings.
+func (client *Client) QueryBatch(ctx context.Context, refs []RepoRef) ([]*RepoStats, []error) {
+	stats := make([]*RepoStats, len(refs))
+	errs := make([]error, len(refs))
+
+	out, err := client.do(ctx, refs)
+	if err != nil {
+		for i := range errs {
+			errs[i] = err
+		}
+		return stats, errs
+	}
+
+	// Errors are attributed to repositories by the first element of their
+	// path, which is the alias. It is replaced with "repository" in the
+	// messages. Errors without a path concern the whole batch.
+	var batchErrs []graphQLError
+	repoErrs := make([][]graphQLError, len(refs))
+	for _, e := range out.Errors {
+		i := -1
+		if len(e.Path) > 0 {
+			alias, _ := e.Path[0].(string)
+			if alias == "rateLimit" {
+				// The rate limit is disabled on some Github
+				// Enterprise Servers, which is not an error of the
+				// repositories.
+				continue
+			}
+			fmt.Sscanf(alias, "r%d", &i)
+		}
+
+		if i < 0 || i >= len(refs) {
+			batchErrs = append(batchErrs, e)
+			continue
+		}
+		e.Path = append([]interface{}{"repository"}, e.Path[1:]...)
+		repoErrs[i] = append(repoErrs[i], e)
+	}
+
+	for i, ref := range refs {
+		if len(batchErrs) > 0 {
+			errs[i] = classifyGraphQLErrors(batchErrs)
+			continue
+		}
+
+		stats[i], errs[i] = client.decodeRepository(ctx, out.Data[fmt.Sprintf("r%d", i)], ref)
+		if errs[i] != nil {
+			// The errors tell better why the repository is missing,
+			// unless it is the branch.
+			if _, ok := errs[i].(*branchNotFoundError); !ok && len(repoErrs[i]) > 0 {
+				errs[i] = classifyGraphQLErrors(repoErrs[i])
+			}
+			continue
+		}
+
+		stats[i].seq = ref.seq
+		stats[i].input = ref.String()
+		stats[i].cached = out.cached
+		for _, e := range repoErrs[i] {
+			stats[i].warnings = append(stats[i].warnings, classifyGraphQLErrors([]graphQLError{e}))
+		}
+	}
+
+	return stats, errs
+}
+
+// do renders and sends the query for a batch of repositories.
+func (client *Client) do(ctx context.Context, refs []RepoRef) (*QueryResult, error) {
+	var queryStmt bytes.Buffer
+	err := client.queryTemplate.Execute(&queryStmt, &struct {
+		Refs       []RepoRef
+		RepoFields string
+		RefFields  string
+	}{
+		Refs:       refs,
+		RepoFields: client.repoFields,
+		RefFields:  client.refFields,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return client.post(ctx, queryStmt.String(), nil)
+}
+
+// post sends a GraphQL query with its variables, and decodes the result.
+// The query should select the rateLimit field, which is used to track the
+// rate limit budget.
+func (client *Client) post(ctx context.Context, query string, variables map[string]interface{}) (*QueryResult, error) {
+	in := struct {
+		Query     string                 `json:"query"`
+		Variables map[string]interface{} `json:"variables,omitempty"`
+	}{
+		Query:     query,
+		Variables: variables,
+	}
+
+	var buf bytes.Buffer
+	err := json.NewEncoder(&buf).Encode(in)
+	if err != nil {
+		return nil, errors.Wrap(err, "json encode failed")
+	}
+
+	// Retry transient errors with an exponential backoff.
+	for retry := 0; ; retry++ {
+		out, err := client.send(ctx, buf.Bytes())
+		e, ok := err.(*classifiedError)
+		if !ok || !e.transient() || retry >= client.retries || ctx.Err() != nil {
+			return out, err
+		}
+
+		if err := sleep(ctx, backoff(retry, e.retryAfter)); err != nil {
+			return nil, e
+		}
+	}
+}
+
+// send sends an encoded GraphQL query once, or once per token of the pool
+// at most, failing over from the revoked and exhausted ones.
+func (client *Client) send(ctx context.Context, body []byte) (*QueryResult, error) {
+	if client.pool == nil {
+		return client.sendCached(ctx, body, client.credential, client.budget, nil)
+	}
+
+	var out *QueryResult
+	var err error
+	for range client.pool.tokens {
+		var t *poolToken
+		if t, err = client.pool.pick(); err != nil {
+			return nil, err
+		}
+		out, err = client.sendCached(ctx, body, t.token, t.budget, t)
+		if err == nil || !client.pool.failover(t, err) {
+			break
+		}
+	}
+	return out, err
+}
+
+// sendCached returns the cached response to an encoded GraphQL query sent
+// with the given credential, or sends it with sendWith and caches the
+// response. Cached responses cost no rate limit points.
+func (client *Client) sendCached(ctx context.Context, body []byte, credential string, b *budget, t *poolToken) (*QueryResult, error) {
+	if out, ok := client.cache.get(client.endpoint, credential, body); ok {
+		return out, nil
+	}
+	out, err := client.sendWith(ctx, body, b, t)
+	if err == nil {
+		client.cache.put(client.endpoint, credential, body, out)
+	}
+	return out, err
+}
+
+// sendWith sends an encoded GraphQL query within a budget, with the token of
+// the pool if t is set.
+func (client *Client) sendWith(ctx context.Context, body []byte, b *budget, t *poolToken) (*QueryResult, error) {
+	// Wait for the rate limit budget.
+	if err := b.acquire(ctx); err != nil {
+		return nil, err
+	}
+
+	if client.timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, client.timeout)
+		defer cancel()
+	}
+
+	req, err := http.NewRequest(http.MethodPost, client.endpoint, bytes.NewReader(body))
+	if err != nil {
+		return nil, errors.Wrap(err, "create request failed")
+	}
+	req.Header.Set("Content-Type", contentType)
+	if t != nil {
+		req.Header.Set("Authorization", "bearer "+t.token)
+	}
+
+	if client.observe != nil {
+		start := time.Now()
+		defer func() { client.observe(time.Since(start)) }()
+	}
+
+	resp, err := client.httpClient.Do(req.WithContext(ctx))
+	if t != nil {
+		client.pool.count(t, 1, 0)
+	}
+	if err != nil {
+		// Failures to get a token are classified already.
+		if e, ok := err.(*url.Error); ok {
+			if ce, ok := e.Err.(*classifiedError); ok {
+				return nil, ce
+			}
+		}
+		return nil, &classifiedError{class: ClassNetworkError, err: errors.Wrap(err, "post request failed")}
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, classifyResponse(resp, b)
+	}
+
+	var out QueryResult
+	err = json.NewDecoder(resp.Body).Decode(&out)
+	if err != nil && err != io.EOF {
+		return nil, &classifiedError{class: ClassNetworkError, err: errors.Wrap(err, "json decode failed")}
+	}
+
+	var rl RateLimit
+	if raw, ok := out.Data["rateLimit"]; ok {
+		if err := json.Unmarshal(raw, &rl); err == nil {
+			b.update(rl)
+		}
+	}
+	if t != nil {
+		client.pool.count(t, 0, rl.Cost)
+	}
+
+	// The whole query is rejected if the rate limit budget is exceeded.
+	for _, e := range out.Errors {
+		if e.Type == "RATE_LIMITED" && len(e.Path) == 0 {
+			b.update(RateLimit{Remaining: 0, ResetAt: rl.ResetAt})
+			return nil, &classifiedError{
+				class: ClassRateLimited,
+				err:   errors.Errorf("query error: %v", e.Message),
+			}
+		}
+	}
+
+	return &out, nil
+}
+
+// decodeRepository converts the aliased repository field of ref to RepoStats.
+// The sampled connections are paged through first.
+func (client *Client) decodeRepository(ctx context.Context, raw json.RawMessage, ref RepoRef) (*RepoStats, error) {
+	if len(raw) == 0 {
+		return nil, errors.Errorf("query error: empty repository")
+	}
+
+	var repo map[string]interface{}
+	if err := json.Unmarshal(raw, &repo); err != nil {
+		return nil, errors.Wrap(err, "json decode failed")
+	}
+	if repo == nil {
+		return nil, errors.Errorf("query error: empty repository")
+	}
+
+	// The specified branch does not exist. Never fall back to the default
+	// branch in that case.
+	if repo["branchRef"] == nil && ref.Branch != "" {
+		return nil, &branchNotFoundError{ref.Branch}
+	}
+
+	if err := client.followPages(ctx, ref, repo); err != nil {
+		return nil, err
+	}
+
+	values := make(map[string]interface{})
+	for _, f := range client.fields {
+		if v := f.extract(repo); v != nil {
+			values[f.name] = v
+		}
+	}
+
+	if values["lastCommit.date"] == nil {
+		return nil, errors.Errorf("query error: empty commit history")
+	}
+	return newRepoStats(values), nil
+}
+
+// newRepoStats returns the RepoStats holding the given values, keyed by the
+// field names.
+func newRepoStats(values map[string]interface{}) *RepoStats {
+	stats := &RepoStats{
+		Name:       FormatValue(values["name"]),
+		URL:        FormatValue(values["url"]),
+		Branch:     FormatValue(values["branch"]),
+		CommitDate: FormatValue(values["lastCommit.date"]),
+		AuthorName: FormatValue(values["lastCommit.author"]),
+		Values:     values,
+	}
+	stats.CommitTime, _ = time.Parse(time.RFC3339, stats.CommitDate)
+	return stats
+}
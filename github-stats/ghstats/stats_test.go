@@ -0,0 +1,57 @@
+package ghstats
+
+import "testing"
+
+func TestParseRepoRef(t *testing.T) {
+	tests := []struct {
+		input         string
+		defaultBranch string
+		want          RepoRef
+		wantErr       bool
+	}{
+		{input: "octocat/hello-world", want: RepoRef{Owner: "octocat", Name: "hello-world"}},
+		{input: "octocat/hello-world@dev", want: RepoRef{Owner: "octocat", Name: "hello-world", Branch: "dev"}},
+		{input: "octocat/hello-world", defaultBranch: "main", want: RepoRef{Owner: "octocat", Name: "hello-world", Branch: "main"}},
+		{input: "octocat/hello-world@dev", defaultBranch: "main", want: RepoRef{Owner: "octocat", Name: "hello-world", Branch: "dev"}},
+		{input: "octocat/hello-world@feature/x", want: RepoRef{Owner: "octocat", Name: "hello-world", Branch: "feature/x"}},
+		{input: "GHE.example.com/org/repo", want: RepoRef{Host: "ghe.example.com", Owner: "org", Name: "repo"}},
+		{input: "ghe.example.com/org/repo@v1", want: RepoRef{Host: "ghe.example.com", Owner: "org", Name: "repo", Branch: "v1"}},
+		{input: "octocat/*", want: RepoRef{Owner: "octocat", Name: "*"}},
+		{input: "octocat", wantErr: true},
+		{input: "octocat/", wantErr: true},
+		{input: "/hello-world", wantErr: true},
+		{input: "/octocat/hello-world", wantErr: true},
+		{input: "a/b/c/d", wantErr: true},
+		{input: "octocat/hello-world@", wantErr: true},
+		{input: "", wantErr: true},
+	}
+
+	for _, tt := range tests {
+		got, err := ParseRepoRef(tt.input, tt.defaultBranch)
+		if tt.wantErr {
+			if err == nil {
+				t.Errorf("ParseRepoRef(%q) = %+v, want an error", tt.input, got)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("ParseRepoRef(%q) failed: %s", tt.input, err)
+			continue
+		}
+		if got != tt.want {
+			t.Errorf("ParseRepoRef(%q) = %+v, want %+v", tt.input, got, tt.want)
+		}
+	}
+}
+
+func TestRepoRefString(t *testing.T) {
+	for _, s := range []string{"octocat/hello-world", "octocat/hello-world@dev", "ghe.example.com/org/repo@v1"} {
+		ref, err := ParseRepoRef(s, "")
+		if err != nil {
+			t.Fatalf("ParseRepoRef(%q) failed: %s", s, err)
+		}
+		if got := ref.String(); got != s {
+			t.Errorf("ParseRepoRef(%q).String() = %q", s, got)
+		}
+	}
+}
@@ -0,0 +1,202 @@
+package ghstats
+
+import (
+	"math"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// TokenUsage reports the use of a token of a pool during a run.
+type TokenUsage struct {
+	// Token is the token masked but for its last characters, e.g. "…3f2a".
+	Token string `json:"token"`
+
+	// Requests counts the requests sent with the token, and Cost the rate
+	// limit points they cost.
+	Requests int `json:"requests"`
+	Cost     int `json:"cost"`
+
+	// Remaining is the rate limit budget left, as of the latest response,
+	// if known.
+	Remaining *int `json:"remaining,omitempty"`
+
+	// Revoked indicates whether the token was rejected as unauthorized.
+	Revoked bool `json:"revoked,omitempty"`
+}
+
+// maskToken returns the last characters of a token, enough to tell the
+// tokens of a pool apart: a quarter of it, 4 at most.
+func maskToken(token string) string {
+	n := len(token) / 4
+	if n > 4 {
+		n = 4
+	}
+	return "…" + token[len(token)-n:]
+}
+
+// poolToken is a token of a pool, with its own rate limit budget.
+type poolToken struct {
+	token  string
+	budget *budget
+
+	// requests, cost and revoked are guarded by the mutex of the pool.
+	requests int
+	cost     int
+	revoked  bool
+}
+
+// tokenPool spreads the queries of a Client over several tokens, each with
+// its own rate limit budget. Every query is sent with the token which has
+// the most points left, and fails over to the next one if the token is
+// revoked or its budget is exhausted.
+type tokenPool struct {
+	mu     sync.Mutex
+	tokens []*poolToken
+}
+
+// newTokenPool returns the pool of the given tokens, or nil if there are
+// none. Duplicates are ignored.
+func newTokenPool(tokens []string, floor int, maxWait time.Duration) *tokenPool {
+	p := &tokenPool{}
+	seen := make(map[string]bool)
+	for _, token := range tokens {
+		if token == "" || seen[token] {
+			continue
+		}
+		seen[token] = true
+		p.tokens = append(p.tokens, &poolToken{token: token, budget: newBudget(floor, maxWait)})
+	}
+	if len(p.tokens) == 0 {
+		return nil
+	}
+	return p
+}
+
+// pick returns the token to send a query with: the one with the most points
+// left above the floor, a token not used yet counting as a full one. If all
+// the budgets are exhausted, it returns the token whose reset comes first.
+// An error is returned once all the tokens are revoked.
+func (p *tokenPool) pick() (*poolToken, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	var best, soonest *poolToken
+	bestHeadroom := 0
+	var soonestReset time.Time
+	for _, t := range p.tokens {
+		if t.revoked {
+			continue
+		}
+		headroom, resetAt := t.budget.headroom()
+		if headroom > bestHeadroom {
+			best, bestHeadroom = t, headroom
+		}
+		if soonest == nil || resetAt.Before(soonestReset) {
+			soonest, soonestReset = t, resetAt
+		}
+	}
+	if best != nil {
+		return best, nil
+	}
+	if soonest != nil {
+		return soonest, nil
+	}
+	return nil, &classifiedError{class: ClassUnauthorized, err: errors.New("all the tokens of the pool are revoked")}
+}
+
+// failover records the failure of a query sent with a token, and reports
+// whether the query should be sent again with another token: if the token
+// is revoked, or if it is rate limited while another one has points left.
+func (p *tokenPool) failover(t *poolToken, err error) bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	switch Classify(err) {
+	case ClassUnauthorized:
+		t.revoked = true
+		for _, other := range p.tokens {
+			if !other.revoked {
+				return true
+			}
+		}
+	case ClassRateLimited:
+		if _, ok := errors.Cause(err).(*budgetError); ok {
+			// The best token is exhausted, so are the others.
+			return false
+		}
+		for _, other := range p.tokens {
+			if other == t || other.revoked {
+				continue
+			}
+			if headroom, _ := other.budget.headroom(); headroom > 0 {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// count records the requests sent with a token, and their cost.
+func (p *tokenPool) count(t *poolToken, requests, cost int) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	t.requests += requests
+	t.cost += cost
+}
+
+// rateLimit returns the sum of the points left of the tokens which are not
+// revoked, and the earliest reset.
+func (p *tokenPool) rateLimit() (remaining int, resetAt time.Time, known bool) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	for _, t := range p.tokens {
+		if t.revoked {
+			continue
+		}
+		if n, reset, ok := t.budget.state(); ok {
+			remaining += n
+			if !known || reset.Before(resetAt) {
+				resetAt = reset
+			}
+			known = true
+		}
+	}
+	return remaining, resetAt, known
+}
+
+// usage reports the use of every token.
+func (p *tokenPool) usage() []TokenUsage {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	usage := make([]TokenUsage, len(p.tokens))
+	for i, t := range p.tokens {
+		usage[i] = TokenUsage{
+			Token:    maskToken(t.token),
+			Requests: t.requests,
+			Cost:     t.cost,
+			Revoked:  t.revoked,
+		}
+		if n, _, ok := t.budget.state(); ok {
+			// The costs reserved by the queries in flight may take the
+			// budget below 0.
+			if n < 0 {
+				n = 0
+			}
+			usage[i].Remaining = &n
+		}
+	}
+	return usage
+}
+
+// headroom returns the points left above the floor, and the reset. The
+// headroom is unbounded if the budget is not known in the current window.
+func (b *budget) headroom() (int, time.Time) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if !b.known || !time.Now().Before(b.resetAt) {
+		return math.MaxInt32, b.resetAt
+	}
+	return b.remaining - b.floor, b.resetAt
+}
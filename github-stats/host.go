@@ -0,0 +1,236 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/yuankunzhang/devops-challenge/github-stats/ghstats"
+	"golang.org/x/oauth2"
+)
+
+// endpointFor returns the GraphQL endpoint of a Github host. The empty host
+// stands for the default endpoint, any other host than github.com is a
+// Github Enterprise Server.
+func endpointFor(host string) string {
+	switch host {
+	case "":
+		return defaultEndpoint
+	case "github.com":
+		return ghstats.GithubEndpoint
+	}
+	return "https://" + host + "/api/graphql"
+}
+
+// tokenEnv returns the environment variable holding the access token for a
+// host, e.g. GITHUB_ACCESS_TOKEN_GHE_EXAMPLE_COM for ghe.example.com.
+func tokenEnv(host string) string {
+	if host == "" {
+		return "GITHUB_ACCESS_TOKEN"
+	}
+	name := strings.Map(func(r rune) rune {
+		if r >= 'a' && r <= 'z' {
+			return r - 'a' + 'A'
+		}
+		if r >= 'A' && r <= 'Z' || r >= '0' && r <= '9' {
+			return r
+		}
+		return '_'
+	}, host)
+	return "GITHUB_ACCESS_TOKEN_" + name
+}
+
+// tokenSource returns the credentials for a host. The default endpoint is
+// authenticated as the Github App if appID is set, or with the token pool,
+// otherwise the access token is looked up along the credential chain. The
+// app tokens are requested with httpClient. The source is nil if the
+// client authenticates the requests itself, with the token pool, or if no
+// credentials are needed to replay a recording.
+func tokenSource(host string, httpClient *http.Client) (oauth2.TokenSource, error) {
+	if replayDir != "" {
+		return nil, nil
+	}
+	isDefault := host == "" || endpointFor(host) == defaultEndpoint
+	if appID != "" && isDefault {
+		return appSource(httpClient)
+	}
+	if len(poolTokens) > 0 && isDefault {
+		return nil, nil
+	}
+
+	token, err := lookupToken(host)
+	if err != nil {
+		return nil, ghstats.WithClass(err, ghstats.ClassUnauthorized)
+	}
+	return oauth2.StaticTokenSource(&oauth2.Token{AccessToken: token}), nil
+}
+
+// cacheCredential returns the identity of the credentials of an endpoint,
+// which the cached responses are keyed by: the app installation, or the
+// access token. It is empty if the client authenticates the requests with
+// the token pool, which are keyed by their token.
+func cacheCredential(endpoint string, src oauth2.TokenSource) string {
+	if src == nil {
+		return ""
+	}
+	// The tokens of the app are renewed, unlike the installation.
+	if appID != "" && endpoint == defaultEndpoint {
+		return fmt.Sprintf("app %s installation %d", appID, appInstallationID)
+	}
+	token, err := src.Token()
+	if err != nil {
+		return ""
+	}
+	return "token " + token.AccessToken
+}
+
+// appSource returns the token source of the Github App installation of the
+// default endpoint.
+func appSource(httpClient *http.Client) (oauth2.TokenSource, error) {
+	keyPEM := []byte(os.Getenv("GITHUB_APP_PRIVATE_KEY"))
+	if appKeyFile != "" {
+		var err error
+		if keyPEM, err = ioutil.ReadFile(appKeyFile); err != nil {
+			return nil, errors.Wrap(err, "read app private key failed")
+		}
+	}
+	if len(keyPEM) == 0 {
+		err := errors.New("no private key for the app: -app-key-file or GITHUB_APP_PRIVATE_KEY not set")
+		return nil, ghstats.WithClass(err, ghstats.ClassUnauthorized)
+	}
+	return ghstats.NewAppTokenSource(appID, keyPEM, appInstallationID, defaultEndpoint, httpClient)
+}
+
+// newTransport returns the transport shared by the clients of all the
+// hosts. If caFile is set, the certificates it holds are trusted besides
+// the system ones. If proxy is set, all the requests go through it,
+// otherwise the proxy is read from the environment.
+func newTransport(caFile, proxy string) (*http.Transport, error) {
+	t := &http.Transport{
+		Proxy: http.ProxyFromEnvironment,
+		DialContext: (&net.Dialer{
+			Timeout:   30 * time.Second,
+			KeepAlive: 30 * time.Second,
+		}).DialContext,
+		MaxIdleConns:          100,
+		IdleConnTimeout:       90 * time.Second,
+		TLSHandshakeTimeout:   10 * time.Second,
+		ExpectContinueTimeout: 1 * time.Second,
+	}
+
+	if caFile != "" {
+		pem, err := ioutil.ReadFile(caFile)
+		if err != nil {
+			return nil, errors.Wrap(err, "read CA bundle failed")
+		}
+		pool, err := x509.SystemCertPool()
+		if err != nil {
+			pool = x509.NewCertPool()
+		}
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, errors.Errorf("no certificates found in %s", caFile)
+		}
+		t.TLSClientConfig = &tls.Config{RootCAs: pool}
+	}
+
+	if proxy != "" {
+		u, err := url.Parse(proxy)
+		if err != nil {
+			return nil, errors.Wrap(err, "invalid proxy")
+		}
+		t.Proxy = http.ProxyURL(u)
+	}
+
+	return t, nil
+}
+
+// hostClients holds one Client per Github host, created on first use, so
+// that a single run can query repositories from several hosts. Each host
+// has its own endpoint, access token and rate limit budget.
+type hostClients struct {
+	mu      sync.Mutex
+	clients map[string]*ghstats.Client
+
+	// errs holds the errors of the hosts without credentials, so that
+	// they are only looked up once.
+	errs map[string]error
+
+	// transport sends the requests of all the clients, including the
+	// ones for the credentials.
+	transport http.RoundTripper
+
+	// newClient creates the client of an endpoint.
+	newClient func(endpoint string, src oauth2.TokenSource) *ghstats.Client
+}
+
+func newHostClients(transport http.RoundTripper, newClient func(endpoint string, src oauth2.TokenSource) *ghstats.Client) *hostClients {
+	return &hostClients{
+		clients:   make(map[string]*ghstats.Client),
+		errs:      make(map[string]error),
+		transport: transport,
+		newClient: newClient,
+	}
+}
+
+// each calls fn with every client created so far, along with its endpoint.
+func (h *hostClients) each(fn func(endpoint string, c *ghstats.Client)) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	for endpoint, c := range h.clients {
+		fn(endpoint, c)
+	}
+}
+
+// client returns the client of a host, the empty host standing for the
+// default endpoint. An error is returned if there are no credentials for
+// the host.
+func (h *hostClients) client(host string) (*ghstats.Client, error) {
+	endpoint := endpointFor(host)
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	if c, ok := h.clients[endpoint]; ok {
+		return c, nil
+	}
+	if err, ok := h.errs[endpoint]; ok {
+		return nil, err
+	}
+
+	src, err := tokenSource(host, &http.Client{Transport: h.transport})
+	if err != nil {
+		h.errs[endpoint] = err
+		return nil, err
+	}
+
+	c := h.newClient(endpoint, src)
+	h.clients[endpoint] = c
+	return c, nil
+}
+
+// tokenUsage reports the use of the token pool of the default endpoint.
+func (h *hostClients) tokenUsage() []ghstats.TokenUsage {
+	c, err := h.client("")
+	if err != nil {
+		return nil
+	}
+	return c.TokenUsage()
+}
+
+// querier is client as a ghstats.Hosts.
+func (h *hostClients) querier(host string) (ghstats.Querier, error) {
+	c, err := h.client(host)
+	if err != nil {
+		return nil, err
+	}
+	return c, nil
+}
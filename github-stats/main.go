@@ -1,209 +1,408 @@
 package main
 
 import (
-	"bufio"
 	"context"
-	"encoding/csv"
 	"flag"
 	"fmt"
 	"io"
+	"net/http"
 	"os"
+	"strconv"
 	"strings"
-	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/yuankunzhang/devops-challenge/github-stats/ghstats"
+	"golang.org/x/oauth2"
 )
 
 var (
-	// accessToken is the personal access token for Github.
+	// accessToken is the personal access token for the default endpoint
+	// set with -token, and tokenFile is the file holding it. They are the
+	// first places of the credential chain.
 	accessToken string
+	tokenFile   string
+
+	// tokensFile is the file holding the pool of access tokens for the
+	// default endpoint, and poolTokens are the tokens of the pool, read
+	// from it or from $GITHUB_ACCESS_TOKENS. They are used instead of the
+	// credential chain if set.
+	tokensFile string
+	poolTokens []string
+
+	// appID, appKeyFile and appInstallationID identify the Github App to
+	// authenticate as, instead of accessToken, if appID is set.
+	appID             string
+	appKeyFile        string
+	appInstallationID int64
+
+	// defaultEndpoint is the GraphQL endpoint of the inputs which don't
+	// name a host.
+	defaultEndpoint string
+
+	// caFile is a PEM bundle of certificates to trust besides the system
+	// ones, and proxyURL is the proxy to send the requests through.
+	caFile   string
+	proxyURL string
 
 	// showSummary indicates whether or not to show summaries.
 	showSummary bool
 
 	// showError indicates whether or not to show errors.
 	showError bool
-)
 
-func init() {
-	summaryFlag := flag.Bool("s", false, "show summaries")
-	errorFlag := flag.Bool("e", false, "show errors")
-	flag.Parse()
+	// rateFloor is the number of rate limit points to leave untouched.
+	rateFloor int
 
-	accessToken = os.Getenv("GITHUB_ACCESS_TOKEN")
-	if accessToken == "" {
-		panic(fmt.Errorf("GITHUB_ACCESS_TOKEN not set"))
-	}
+	// maxWait is the longest time to pause for a rate limit reset.
+	maxWait time.Duration
 
-	showSummary = *summaryFlag
-	showError = *errorFlag
-}
+	// concurrency is the number of workers querying the API.
+	concurrency int
 
-func main() {
-	// in is the data input channel.
-	// ie is the channel that collects input errors.
-	in, ie := input(os.Stdin)
+	// rps caps the number of queries issued per second, 0 means no cap.
+	rps float64
 
-	// out is the result output channel.
-	// qe is the channel that collects query errors.
-	out, qe := query(in)
+	// batchSize is the number of repositories queried per request.
+	batchSize int
 
-	// done will be closed once all output are flushed.
-	done := output(os.Stdout, out, ie, qe)
+	// outputFormat is the format of the output, see ghstats.Formats.
+	outputFormat = formatFlag(ghstats.Formats[0])
 
-	// Wait until result outputted.
-	<-done
+	// sortKey is the order of the output, see ghstats.SortKeys.
+	sortKey = sortFlag(ghstats.SortKeys[0])
+
+	// sortDesc indicates whether or not to sort in descending order.
+	sortDesc bool
+
+	// outputFields are the fields to output.
+	outputFields fieldsFlag
+
+	// requestTimeout is the timeout of each request, 0 means no timeout.
+	requestTimeout time.Duration
+
+	// deadline is the timeout of the whole run, 0 means no timeout.
+	deadline time.Duration
+
+	// retries is the maximum number of retries of a failed request.
+	retries int
+
+	// gracePeriod is how long the in-flight queries are given to complete
+	// once the run is interrupted or reaches its deadline.
+	gracePeriod time.Duration
+
+	// expandFilter selects the repositories $orgname/* is expanded into.
+	expandFilter ghstats.OwnerFilter
+
+	// searchTerms is the search query of the repositories to query
+	// besides the input, and searchLimit is the maximum number of search
+	// results.
+	searchTerms string
+	searchLimit int
+
+	// cacheDir is the directory of the response cache, and cacheTTL is
+	// how long the responses are reused. noCache disables the cache.
+	cacheDir string
+	cacheTTL time.Duration
+	noCache  bool
+
+	// sinceFile is the output of a previous run to compare the results
+	// with. showUnchanged indicates whether or not to output the
+	// repositories which did not change since then.
+	sinceFile     string
+	showUnchanged bool
+
+	// staleAfter is the age beyond which the latest commit of a
+	// repository is stale, and staleOverrides is the file setting it per
+	// repository.
+	staleAfter     ageFlag
+	staleOverrides string
+
+	// defaultBranch is the branch to query if an input does not specify
+	// one. If empty, the default branch of each repository is queried.
+	defaultBranch string
+
+	// sampleSize is the number of closed pull requests the health fields are
+	// computed from.
+	sampleSize int
+
+	// recordDir is the directory to save the requests and responses in,
+	// and replayDir the one to serve them from instead of Github.
+	recordDir string
+	replayDir string
+)
+
+// registerClientFlags registers the options of the clients on fs, which are
+// shared by all the commands.
+func registerClientFlags(fs *flag.FlagSet) {
+	fs.StringVar(&accessToken, "token", "", "personal access token for the default endpoint, see the README for the other ways to set it")
+	fs.StringVar(&tokenFile, "token-file", os.Getenv("GITHUB_ACCESS_TOKEN_FILE"), "file holding the access token for the default endpoint, defaults to $GITHUB_ACCESS_TOKEN_FILE")
+	fs.StringVar(&tokensFile, "tokens-file", os.Getenv("GITHUB_ACCESS_TOKENS_FILE"), "file holding a pool of access tokens for the default endpoint, one per line, defaults to $GITHUB_ACCESS_TOKENS_FILE or the comma separated $GITHUB_ACCESS_TOKENS")
+	fs.IntVar(&rateFloor, "rate-floor", 100, "rate limit points to leave untouched")
+	fs.DurationVar(&maxWait, "max-wait", time.Hour, "longest time to pause for a rate limit reset before giving up")
+	fs.IntVar(&concurrency, "c", 10, "number of concurrent queries (shorthand)")
+	fs.IntVar(&concurrency, "concurrency", 10, "number of concurrent queries")
+	fs.DurationVar(&requestTimeout, "timeout", 30*time.Second, "timeout of each request, 0 means no timeout")
+	fs.IntVar(&retries, "retries", 3, "maximum number of retries of a request failing with a transient error")
+	fs.DurationVar(&gracePeriod, "grace", 10*time.Second, "time given to in-flight queries once interrupted or past the deadline")
+	outputFields = ghstats.DefaultFields()
+	fs.Var(&outputFields, "fields", "comma separated fields to output: "+strings.Join(ghstats.FieldNames(), ","))
+	fs.StringVar(&defaultEndpoint, "endpoint", os.Getenv("GITHUB_GRAPHQL_URL"), "GraphQL endpoint of the inputs without a host, defaults to $GITHUB_GRAPHQL_URL or "+ghstats.GithubEndpoint)
+	fs.StringVar(&appID, "app-id", os.Getenv("GITHUB_APP_ID"), "ID of the Github App to authenticate as, defaults to $GITHUB_APP_ID")
+	fs.StringVar(&appKeyFile, "app-key-file", os.Getenv("GITHUB_APP_PRIVATE_KEY_FILE"), "private key of the Github App, defaults to $GITHUB_APP_PRIVATE_KEY_FILE, or the key in $GITHUB_APP_PRIVATE_KEY")
+	installationID, _ := strconv.ParseInt(os.Getenv("GITHUB_APP_INSTALLATION_ID"), 10, 64)
+	fs.Int64Var(&appInstallationID, "app-installation-id", installationID, "installation of the Github App, defaults to $GITHUB_APP_INSTALLATION_ID, or the only installation of the app")
+	fs.StringVar(&caFile, "ca-file", "", "PEM bundle of certificates to trust besides the system ones")
+	fs.StringVar(&proxyURL, "proxy", "", "proxy URL, defaults to $HTTPS_PROXY")
+	fs.StringVar(&cacheDir, "cache-dir", "", "directory of the response cache, defaults to $XDG_CACHE_HOME/github-stats or ~/.cache/github-stats")
+	fs.DurationVar(&cacheTTL, "cache-ttl", 0, "how long the cached responses are reused, 0 disables the cache")
+	fs.BoolVar(&noCache, "no-cache", false, "neither read nor write the response cache")
+	fs.IntVar(&sampleSize, "sample", ghstats.DefaultSample, "number of the latest closed pull requests the prs.* fields are computed from")
+	fs.StringVar(&defaultBranch, "branch", "", "branch to query unless specified as $orgname/$repo@$branch, defaults to the default branch of each repository")
+	fs.StringVar(&recordDir, "record", "", "directory to save the requests and responses in, with the tokens scrubbed")
+	fs.StringVar(&replayDir, "replay", "", "directory of the recordings to serve the responses from, instead of querying Github")
 }
 
-// inputError represents an error occurred when accepting user input.
-type inputError struct {
-	input string
-	error error
+// setClientDefaults sets the defaults of the client options which depend on
+// others, or on the environment, once they are parsed.
+func setClientDefaults() {
+	if defaultEndpoint == "" {
+		defaultEndpoint = ghstats.GithubEndpoint
+	}
+	if cacheDir == "" {
+		cacheDir = ghstats.DefaultCacheDir()
+	}
+	if concurrency < 1 {
+		concurrency = 1
+	}
+	// All the requests are sent while recording, and none while
+	// replaying. A batch is matched by the repositories it holds, which
+	// depends on the timing, so every repository is queried on its own.
+	if recordDir != "" || replayDir != "" {
+		noCache = true
+		batchSize = 1
+	}
 }
 
-// queryError represents an error occurred when requesting to Github API.
-type queryError struct {
-	input string
-	error error
+// parseFlags registers the options on fs, and parses them from args.
+func parseFlags(fs *flag.FlagSet, args []string) error {
+	registerClientFlags(fs)
+	fs.BoolVar(&showSummary, "s", false, "show summaries")
+	fs.BoolVar(&showError, "e", false, "show errors")
+	fs.Float64Var(&rps, "rps", 0, "maximum queries per second, 0 means no limit")
+	fs.IntVar(&batchSize, "batch", 1, "number of repositories queried per request")
+	fs.DurationVar(&deadline, "deadline", 0, "timeout of the whole run, 0 means no timeout")
+	fs.Var(&outputFormat, "o", "output format: "+strings.Join(ghstats.Formats, "|"))
+	fs.Var(&sortKey, "sort", "output order: "+strings.Join(ghstats.SortKeys, "|"))
+	fs.BoolVar(&sortDesc, "desc", false, "sort in descending order")
+	fs.BoolVar(&expandFilter.IncludeForks, "include-forks", false, "include forks when expanding $orgname/*")
+	fs.BoolVar(&expandFilter.IncludeArchived, "include-archived", false, "include archived repositories when expanding $orgname/*")
+	visibility := visibilityFlag(ghstats.Visibilities[0])
+	fs.Var(&visibility, "visibility", "visibility of the repositories when expanding $orgname/*: "+strings.Join(ghstats.Visibilities, "|"))
+	fs.StringVar(&searchTerms, "search", "", "also query the repositories matching this search query, e.g. \"language:go stars:>1000\"")
+	fs.IntVar(&searchLimit, "limit", 100, "maximum number of search results, 0 means no limit")
+	fs.StringVar(&sinceFile, "since-file", "", "output of a previous run, in the csv, json or ndjson format, to only report the changes since then")
+	fs.BoolVar(&showUnchanged, "unchanged", false, "also output the unchanged repositories with -since-file")
+	fs.Var(&staleAfter, "stale-after", "mark the repositories whose latest commit is older than this as stale, e.g. 180d")
+	fs.StringVar(&staleOverrides, "stale-overrides", "", "file setting -stale-after per repository")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+
+	setClientDefaults()
+	expandFilter.Visibility = string(visibility)
+	if batchSize < 1 {
+		batchSize = 1
+	}
+	return nil
 }
 
-func input(r io.Reader) (<-chan string, <-chan inputError) {
-	in := make(chan string)
-	errc := make(chan inputError)
-	go func() {
-		defer close(in)
-		defer close(errc)
-
-		// This map is used to remove duplicates.
-		uniqueMap := make(map[string]struct{})
-
-		scanner := bufio.NewScanner(r)
-
-		// Read from stdin, until EOF.
-		for scanner.Scan() {
-			s := strings.TrimSpace(scanner.Text())
-
-			// Empty?
-			if s == "" {
-				continue
-			}
-
-			// Invalid?
-			if len(strings.Split(s, "/")) != 2 {
-				errc <- inputError{s, fmt.Errorf("invalid input: should be in format of $orgname/$repo")}
-				continue
-			}
-
-			// Duplicated?
-			if _, ok := uniqueMap[s]; ok {
-				continue
-			}
-			uniqueMap[s] = struct{}{}
-			in <- s
+// newHosts returns the clients of all the hosts, which query the given
+// fields. If observe is set, it is called with the latency of every
+// request, along with the endpoint. It fails if the default endpoint has no
+// credentials: they are required, while the ones of the other hosts are
+// looked up when they are first needed.
+func newHosts(fields []*ghstats.Field, observe func(endpoint string, d time.Duration)) (*hostClients, error) {
+	transport, err := newTransport(caFile, proxyURL)
+	if err != nil {
+		return nil, err
+	}
+
+	if poolTokens, err = readTokensFile(); err != nil {
+		return nil, err
+	}
+
+	// The queries are recorded on their way to Github, or served from the
+	// recordings without credentials. The app tokens are neither recorded
+	// nor replayed.
+	var base http.RoundTripper = transport
+	switch {
+	case recordDir != "" && replayDir != "":
+		return nil, errors.New("-record and -replay are mutually exclusive")
+	case recordDir != "":
+		if base, err = ghstats.NewRecorder(recordDir, transport); err != nil {
+			return nil, err
 		}
-	}()
-	return in, errc
-}
+	case replayDir != "":
+		if base, err = ghstats.NewReplayer(replayDir); err != nil {
+			return nil, err
+		}
+	}
 
-func query(in <-chan string) (<-chan *RepoStats, <-chan queryError) {
-	out := make(chan *RepoStats)
-	errc := make(chan queryError)
-
-	go func() {
-		defer close(out)
-		defer close(errc)
-		var wg sync.WaitGroup
-
-		client := NewClient(context.Background(), accessToken)
-
-		for s := range in {
-			wg.Add(1)
-			go func(s string) {
-				defer wg.Done()
-				fields := strings.Split(s, "/")
-				stats, err := client.Query(fields[0], fields[1])
-				if err != nil {
-					errc <- queryError{s, err}
-					return
-				}
-				out <- stats
-			}(s)
+	// The cache is shared by all the hosts, it is keyed by the endpoint and
+	// the credentials.
+	var c *ghstats.Cache
+	if !noCache {
+		c = ghstats.NewCache(cacheDir, cacheTTL)
+	}
+
+	// Every host gets its own client, with its own rate limit budget.
+	hosts := newHostClients(transport, func(endpoint string, src oauth2.TokenSource) *ghstats.Client {
+		opts := ghstats.Options{
+			Fields:    fields,
+			RateFloor: rateFloor,
+			MaxWait:   maxWait,
+			Timeout:   requestTimeout,
+			Retries:   retries,
+			Cache:     c,
+			Sample:    sampleSize,
+		}
+		if c != nil {
+			opts.Credential = cacheCredential(endpoint, src)
+		}
+		if observe != nil {
+			opts.Observe = func(d time.Duration) { observe(endpoint, d) }
+		}
+		// The app authenticates the requests itself, so the pool would
+		// only be overridden.
+		if endpoint == defaultEndpoint && appID == "" {
+			opts.Tokens = poolTokens
 		}
+		httpClient := &http.Client{Transport: base}
+		if src != nil {
+			httpClient.Transport = &oauth2.Transport{Source: src, Base: base}
+		}
+		return ghstats.NewClient(httpClient, endpoint, opts)
+	})
 
-		wg.Wait()
-	}()
-	return out, errc
+	if _, err := hosts.client(""); err != nil {
+		return nil, err
+	}
+	return hosts, nil
 }
 
-func output(w io.Writer, out <-chan *RepoStats, ie <-chan inputError, qe <-chan queryError) <-chan struct{} {
-	done := make(chan struct{})
-	go func() {
-		defer close(done)
-		var wg sync.WaitGroup
-
-		var total = 0
-		var csvRecords [][]string
-		var inputErrors []inputError
-		var queryErrors []queryError
-
-		wg.Add(3)
-
-		// Collect csv records.
-		go func() {
-			defer wg.Done()
-			for o := range out {
-				total += 1
-				csvRecords = append(csvRecords, o.CsvRecord())
-			}
-		}()
-
-		// Collect input errors.
-		go func() {
-			defer wg.Done()
-			for e := range ie {
-				total += 1
-				inputErrors = append(inputErrors, e)
-			}
-		}()
-
-		// Collect query errors.
-		go func() {
-			defer wg.Done()
-			for e := range qe {
-				total += 1
-				queryErrors = append(queryErrors, e)
-			}
-		}()
-
-		wg.Wait()
-
-		if len(csvRecords) > 0 {
-			writer := csv.NewWriter(w)
-			writer.Write(CsvHeader())
-			writer.WriteAll(csvRecords)
-			writer.Flush()
+func main() {
+	// Dispatch the subcommands.
+	if len(os.Args) > 1 {
+		switch os.Args[1] {
+		case "serve":
+			serve(os.Args[2:])
+			return
+		case "exporter":
+			export(os.Args[2:])
+			return
 		}
+	}
 
-		if showError {
-			if len(inputErrors) > 0 {
-				fmt.Printf("\n\nInput Errors:\n")
-				for _, ie := range inputErrors {
-					fmt.Printf("  <%s> %s\n", ie.input, ie.error)
-				}
-			}
-
-			if len(queryErrors) > 0 {
-				fmt.Printf("\n\nQuery Errors:\n")
-				for _, ie := range queryErrors {
-					fmt.Printf("  <%s> %s\n", ie.input, ie.error)
-				}
-			}
+	if err := parseFlags(flag.CommandLine, os.Args[1:]); err != nil {
+		os.Exit(2)
+	}
+
+	// ctx is cancelled when the run is interrupted or reaches its deadline.
+	// No new queries are issued after that.
+	ctx, cancel := withSignals(context.Background())
+	defer cancel()
+	if deadline > 0 {
+		ctx, cancel = context.WithTimeout(ctx, deadline)
+		defer cancel()
+	}
+
+	// Tell the stale repositories, if requested.
+	var p *ghstats.StalePolicy
+	if staleAfter > 0 || staleOverrides != "" {
+		var err error
+		if p, err = ghstats.LoadStalePolicy(time.Duration(staleAfter), staleOverrides, credentialHost("")); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(2)
 		}
+	}
 
-		if showSummary {
-			fmt.Printf("\n\nSummaries:\n")
-			fmt.Printf("  Total Unique Inputs (not including empty lines): %d\n", total)
-			fmt.Printf("  Succeeded: %d\n", len(csvRecords))
-			fmt.Printf("  Failed: %d\n", len(inputErrors)+len(queryErrors))
+	// The archived repositories are told apart, whether the isArchived
+	// field is output or not.
+	queryFields := outputFields
+	if p != nil {
+		queryFields = append(append(fieldsFlag{}, outputFields...), ghstats.LookupField("isArchived"))
+	}
+
+	hosts, err := newHosts(queryFields, nil)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(startupExitCode(err))
+	}
+
+	// Compare the results with a previous run, if requested.
+	var d *ghstats.Differ
+	if sinceFile != "" {
+		prev, err := ghstats.LoadSnapshot(sinceFile)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(2)
 		}
-	}()
-	return done
+		d = ghstats.NewDiffer(prev, credentialHost(""))
+	}
+
+	// Don't wait for the user to type anything if the repositories are
+	// searched for.
+	var stdin io.Reader = os.Stdin
+	if fi, err := os.Stdin.Stat(); searchTerms != "" && err == nil && fi.Mode()&os.ModeCharDevice != 0 {
+		stdin = nil
+	}
+
+	// in is the data input channel.
+	// ie is the channel that collects input errors.
+	in, ie := ghstats.Input(ctx, stdin, hosts.querier, ghstats.InputOptions{
+		DefaultBranch: defaultBranch,
+		Expand:        expandFilter,
+		Search:        searchTerms,
+		SearchLimit:   searchLimit,
+	})
+
+	// out is the result output channel.
+	// qe is the channel that collects query errors.
+	out, qe := ghstats.Query(ctx, hosts.querier, in, ghstats.QueryOptions{
+		Concurrency: concurrency,
+		RPS:         rps,
+		BatchSize:   batchSize,
+		GracePeriod: gracePeriod,
+	})
+
+	// done receives the report once all output are flushed.
+	done := ghstats.Output(ctx, os.Stdout, out, ie, qe, ghstats.OutputOptions{
+		Format:        string(outputFormat),
+		Fields:        outputFields,
+		Sort:          string(sortKey),
+		Desc:          sortDesc,
+		ShowErrors:    showError,
+		ShowSummary:   showSummary,
+		Stale:         p,
+		Diff:          d,
+		ShowUnchanged: showUnchanged,
+		TokenUsage:    hosts.tokenUsage,
+		Log:           os.Stderr,
+	})
+
+	// Wait until result outputted.
+	r := <-done
+	cancel()
+	os.Exit(r.ExitCode())
+}
+
+// startupExitCode returns the exit code of a failure to start a run: the one
+// of its class if it is classified, or 2 as for the usage errors otherwise,
+// e.g. for invalid files given as options.
+func startupExitCode(err error) int {
+	if ghstats.IsClassified(err) {
+		return ghstats.Classify(err).ExitCode()
+	}
+	return 2
 }
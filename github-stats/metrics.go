@@ -0,0 +1,147 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// metric is a metric family, written in the Prometheus text format.
+type metric struct {
+	name string
+	typ  string
+	help string
+
+	samples []sample
+}
+
+// sample is a value of a metric. The labels are given as name value pairs.
+type sample struct {
+	suffix string
+	labels []string
+	value  float64
+}
+
+func newMetric(name, typ, help string) *metric {
+	return &metric{name: name, typ: typ, help: help}
+}
+
+// add adds a sample with the given labels, as name value pairs.
+func (m *metric) add(value float64, labels ...string) {
+	m.samples = append(m.samples, sample{labels: labels, value: value})
+}
+
+var (
+	helpEscaper  = strings.NewReplacer(`\`, `\\`, "\n", `\n`)
+	labelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+)
+
+// writeMetrics writes the metrics in the Prometheus text format.
+func writeMetrics(w io.Writer, metrics []*metric) error {
+	bw := bufio.NewWriter(w)
+	for _, m := range metrics {
+		fmt.Fprintf(bw, "# HELP %s %s\n", m.name, helpEscaper.Replace(m.help))
+		fmt.Fprintf(bw, "# TYPE %s %s\n", m.name, m.typ)
+		for _, s := range m.samples {
+			bw.WriteString(m.name + s.suffix)
+			if len(s.labels) > 0 {
+				bw.WriteByte('{')
+				for i := 0; i+1 < len(s.labels); i += 2 {
+					if i > 0 {
+						bw.WriteByte(',')
+					}
+					fmt.Fprintf(bw, `%s="%s"`, s.labels[i], labelEscaper.Replace(s.labels[i+1]))
+				}
+				bw.WriteByte('}')
+			}
+			fmt.Fprintf(bw, " %s\n", formatSample(s.value))
+		}
+	}
+	return bw.Flush()
+}
+
+// formatSample formats a value, integers in full rather than in the
+// exponent format, which is hard to read for the dates.
+func formatSample(v float64) string {
+	if v == math.Trunc(v) && math.Abs(v) < 1e15 {
+		return strconv.FormatInt(int64(v), 10)
+	}
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
+
+// latencyBuckets are the upper bounds of the buckets of the latency
+// histograms, in seconds.
+var latencyBuckets = []float64{.1, .25, .5, 1, 2.5, 5, 10, 30}
+
+// histogram counts observations in buckets, for every value of a label.
+type histogram struct {
+	mu     sync.Mutex
+	label  string
+	bounds []float64
+	series map[string]*histogramSeries
+}
+
+type histogramSeries struct {
+	// counts holds the count of every bucket, the last one being +Inf.
+	// They are not cumulative.
+	counts []uint64
+	sum    float64
+}
+
+func newHistogram(label string, bounds []float64) *histogram {
+	return &histogram{label: label, bounds: bounds, series: make(map[string]*histogramSeries)}
+}
+
+// observe records a value for the given label value.
+func (h *histogram) observe(labelValue string, v float64) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	s, ok := h.series[labelValue]
+	if !ok {
+		s = &histogramSeries{counts: make([]uint64, len(h.bounds)+1)}
+		h.series[labelValue] = s
+	}
+	s.counts[sort.SearchFloat64s(h.bounds, v)]++
+	s.sum += v
+}
+
+// metric returns the histogram as a metric family.
+func (h *histogram) metric(name, help string) *metric {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	m := newMetric(name, "histogram", help)
+	values := make([]string, 0, len(h.series))
+	for v := range h.series {
+		values = append(values, v)
+	}
+	sort.Strings(values)
+
+	for _, v := range values {
+		s := h.series[v]
+		var count uint64
+		for i, c := range s.counts {
+			count += c
+			le := math.Inf(1)
+			if i < len(h.bounds) {
+				le = h.bounds[i]
+			}
+			m.samples = append(m.samples, sample{
+				suffix: "_bucket",
+				labels: []string{h.label, v, "le", strconv.FormatFloat(le, 'g', -1, 64)},
+				value:  float64(count),
+			})
+		}
+		m.samples = append(m.samples,
+			sample{suffix: "_sum", labels: []string{h.label, v}, value: s.sum},
+			sample{suffix: "_count", labels: []string{h.label, v}, value: float64(count)},
+		)
+	}
+	return m
+}
@@ -0,0 +1,363 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/yuankunzhang/devops-challenge/github-stats/ghstats"
+)
+
+// maxBatchRepos is the maximum number of repositories of a batch request,
+// and maxBatchBytes the maximum size of its body.
+const (
+	maxBatchRepos = 100
+	maxBatchBytes = 64 << 10
+)
+
+// defaultServeTTL is how long the stats are kept in memory by default.
+const defaultServeTTL = 15 * time.Minute
+
+// repoCache keeps the stats of the repositories in memory for a while, and
+// coalesces the concurrent lookups of the same repository into a single
+// query.
+type repoCache struct {
+	mu      sync.Mutex
+	ttl     time.Duration
+	entries map[string]repoEntry
+
+	// pruned is when the expired entries were last removed.
+	pruned time.Time
+
+	// calls holds the lookups in flight.
+	calls map[string]*lookupCall
+}
+
+type repoEntry struct {
+	stats   *ghstats.RepoStats
+	expires time.Time
+}
+
+// lookupCall is a lookup in flight, whose result is shared by all the
+// callers once done is closed.
+type lookupCall struct {
+	done  chan struct{}
+	stats *ghstats.RepoStats
+	err   error
+}
+
+func newRepoCache(ttl time.Duration) *repoCache {
+	return &repoCache{
+		ttl:     ttl,
+		entries: make(map[string]repoEntry),
+		calls:   make(map[string]*lookupCall),
+	}
+}
+
+// get returns the cached stats of a repository, or calls fetch to query
+// them. If a lookup of the same repository is in flight, its result is
+// waited for instead. Only successes are cached.
+func (c *repoCache) get(key string, fetch func() (*ghstats.RepoStats, error)) (*ghstats.RepoStats, error) {
+	c.mu.Lock()
+	if e, ok := c.entries[key]; ok && time.Now().Before(e.expires) {
+		c.mu.Unlock()
+		return e.stats, nil
+	}
+	if call, ok := c.calls[key]; ok {
+		c.mu.Unlock()
+		<-call.done
+		return call.stats, call.err
+	}
+	call := &lookupCall{done: make(chan struct{})}
+	c.calls[key] = call
+	c.mu.Unlock()
+
+	call.stats, call.err = fetch()
+
+	c.mu.Lock()
+	delete(c.calls, key)
+	if call.err == nil && c.ttl > 0 {
+		now := time.Now()
+		c.prune(now)
+		c.entries[key] = repoEntry{call.stats, now.Add(c.ttl)}
+	}
+	c.mu.Unlock()
+	close(call.done)
+
+	return call.stats, call.err
+}
+
+// prune removes the expired entries, at most once per TTL, so that the
+// cache only holds the repositories looked up within the last two TTLs.
+// It must be called with the mutex held.
+func (c *repoCache) prune(now time.Time) {
+	if now.Before(c.pruned.Add(c.ttl)) {
+		return
+	}
+	for key, e := range c.entries {
+		if !now.Before(e.expires) {
+			delete(c.entries, key)
+		}
+	}
+	c.pruned = now
+}
+
+// server serves the stats of the repositories over HTTP.
+type server struct {
+	hosts *hostClients
+	cache *repoCache
+
+	// served holds the hosts the repositories can be queried from besides
+	// the default endpoint. Any other host is rejected, so that clients
+	// can't have credentials looked up for arbitrary hosts.
+	served map[string]bool
+
+	// sem bounds the number of queries in flight.
+	sem chan struct{}
+}
+
+func newServer(hosts *hostClients, served []string, ttl time.Duration) *server {
+	s := &server{
+		hosts:  hosts,
+		cache:  newRepoCache(ttl),
+		served: make(map[string]bool),
+		sem:    make(chan struct{}, concurrency),
+	}
+	for _, host := range served {
+		s.served[host] = true
+	}
+	return s
+}
+
+// handler routes the requests.
+func (s *server) handler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/repos/", s.handleRepo)
+	mux.HandleFunc("/repos:batch", s.handleBatch)
+	mux.HandleFunc("/healthz", s.handleHealth)
+	mux.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
+		writeError(w, http.StatusNotFound, errors.New("not found"))
+	})
+	return mux
+}
+
+// parseRef parses a repository of a request, which must not be a wildcard
+// and must live on a served host.
+func (s *server) parseRef(input, branch string) (ghstats.RepoRef, error) {
+	ref, err := ghstats.ParseRepoRef(strings.TrimSpace(input), branch)
+	if err != nil {
+		return ref, err
+	}
+	if ref.IsWildcard() {
+		return ref, errors.New("invalid input: wildcards are not supported")
+	}
+	if ref.Host != "" && !s.served[ref.Host] && endpointFor(ref.Host) != endpointFor("") {
+		return ref, errors.Errorf("invalid input: host %s is not served", ref.Host)
+	}
+	return ref, nil
+}
+
+// lookup returns the stats of a repository. The query is not bound to the
+// request, since other requests may be waiting for it.
+func (s *server) lookup(ref ghstats.RepoRef) (*ghstats.RepoStats, error) {
+	return s.cache.get(strings.ToLower(ref.String()), func() (*ghstats.RepoStats, error) {
+		client, err := s.hosts.client(ref.Host)
+		if err != nil {
+			return nil, err
+		}
+
+		s.sem <- struct{}{}
+		defer func() { <-s.sem }()
+		return client.Query(context.Background(), ref.Owner, ref.Name, ref.Branch)
+	})
+}
+
+// handleRepo serves GET /repos/{owner}/{name}, or
+// /repos/{host}/{owner}/{name} for another host than the default one. The
+// branch may be set with the branch parameter.
+func (s *server) handleRepo(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeError(w, http.StatusMethodNotAllowed, errors.New("method not allowed"))
+		return
+	}
+
+	ref, err := s.parseRef(strings.TrimPrefix(r.URL.Path, "/repos/"), r.URL.Query().Get("branch"))
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+
+	stats, err := s.lookup(ref)
+	if err != nil {
+		writeError(w, httpStatus(err), err)
+		return
+	}
+	writeJSON(w, http.StatusOK, ghstats.JSONRecord{Fields: outputFields, Stats: stats})
+}
+
+// handleBatch serves POST /repos:batch, whose body lists the repositories
+// in the same format as the input lines of the command:
+//
+//	{"repos": ["octocat/hello-world", "kubernetes/charts@master"]}
+//
+// The response holds the results in the same order, and the errors.
+func (s *server) handleBatch(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		writeError(w, http.StatusMethodNotAllowed, errors.New("method not allowed"))
+		return
+	}
+
+	var in struct {
+		Repos []string `json:"repos"`
+	}
+	if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, maxBatchBytes)).Decode(&in); err != nil {
+		writeError(w, http.StatusBadRequest, errors.Wrap(err, "invalid request"))
+		return
+	}
+	if len(in.Repos) > maxBatchRepos {
+		writeError(w, http.StatusBadRequest, errors.Errorf("too many repositories, the maximum is %d", maxBatchRepos))
+		return
+	}
+
+	stats := make([]*ghstats.RepoStats, len(in.Repos))
+	errs := make([]error, len(in.Repos))
+	kinds := make([]string, len(in.Repos))
+	var wg sync.WaitGroup
+	for i, input := range in.Repos {
+		ref, err := s.parseRef(input, "")
+		if err != nil {
+			errs[i], kinds[i] = err, "input"
+			continue
+		}
+
+		kinds[i] = "query"
+		wg.Add(1)
+		go func(i int, ref ghstats.RepoRef) {
+			defer wg.Done()
+			stats[i], errs[i] = s.lookup(ref)
+		}(i, ref)
+	}
+	wg.Wait()
+
+	out := struct {
+		Results []ghstats.JSONRecord  `json:"results"`
+		Errors  []ghstats.ErrorRecord `json:"errors"`
+	}{
+		Results: []ghstats.JSONRecord{},
+		Errors:  []ghstats.ErrorRecord{},
+	}
+	for i, input := range in.Repos {
+		if errs[i] != nil {
+			out.Errors = append(out.Errors, ghstats.ErrorRecord{Kind: kinds[i], Class: ghstats.Classify(errs[i]).String(), Input: input, Error: errs[i].Error()})
+			continue
+		}
+		out.Results = append(out.Results, ghstats.JSONRecord{Fields: outputFields, Stats: stats[i]})
+	}
+	writeJSON(w, http.StatusOK, out)
+}
+
+// handleHealth serves GET /healthz.
+func (s *server) handleHealth(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, map[string]string{"status": "ok"})
+}
+
+// httpStatus returns the status code of the response to a failed lookup.
+func httpStatus(err error) int {
+	switch ghstats.Classify(err) {
+	case ghstats.ClassNotFound:
+		return http.StatusNotFound
+	case ghstats.ClassRateLimited:
+		return http.StatusServiceUnavailable
+	case ghstats.ClassUnknown:
+		return http.StatusInternalServerError
+	}
+	return http.StatusBadGateway
+}
+
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
+}
+
+// writeError writes an error response, along with the class of the error
+// if it is known.
+func writeError(w http.ResponseWriter, status int, err error) {
+	var class string
+	if c := ghstats.Classify(err); c != ghstats.ClassUnknown {
+		class = c.String()
+	}
+	writeJSON(w, status, struct {
+		Class string `json:"class,omitempty"`
+		Error string `json:"error"`
+	}{class, err.Error()})
+}
+
+// serve runs the serve command, which serves the stats of the repositories
+// over HTTP until it is interrupted.
+func serve(args []string) {
+	fs := flag.NewFlagSet("serve", flag.ExitOnError)
+	registerClientFlags(fs)
+	listen := fs.String("listen", ":8080", "address to listen on")
+	servedHosts := fs.String("hosts", "", "comma separated hosts the repositories can be queried from besides the default endpoint, e.g. ghe.example.com")
+	fs.Parse(args)
+	setClientDefaults()
+
+	// The stats are kept in memory for defaultServeTTL, unless -cache-ttl
+	// is set, which enables the disk cache as well.
+	ttl := defaultServeTTL
+	fs.Visit(func(f *flag.Flag) {
+		if f.Name == "cache-ttl" {
+			ttl = cacheTTL
+		}
+	})
+
+	hosts, err := newHosts(outputFields, nil)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(startupExitCode(err))
+	}
+
+	// The credentials of the served hosts are looked up once, at startup.
+	var served []string
+	for _, host := range strings.Split(*servedHosts, ",") {
+		if host = strings.ToLower(strings.TrimSpace(host)); host == "" {
+			continue
+		}
+		if _, err := hosts.client(host); err != nil {
+			fmt.Fprintf(os.Stderr, "%s: %s\n", host, err)
+			os.Exit(startupExitCode(err))
+		}
+		served = append(served, host)
+	}
+
+	ctx, cancel := withSignals(context.Background())
+	defer cancel()
+
+	srv := &http.Server{Addr: *listen, Handler: newServer(hosts, served, ttl).handler()}
+
+	// Stop accepting requests once interrupted, and give the ones in
+	// flight the grace period to complete.
+	stopped := make(chan struct{})
+	go func() {
+		defer close(stopped)
+		<-ctx.Done()
+		shutdownCtx, cancel := context.WithTimeout(context.Background(), gracePeriod)
+		defer cancel()
+		srv.Shutdown(shutdownCtx)
+	}()
+
+	fmt.Fprintf(os.Stderr, "listening on %s\n", *listen)
+	if err := srv.ListenAndServe(); err != http.ErrServerClosed {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+	<-stopped
+}